@@ -0,0 +1,214 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var errBuild = errors.New("builder")
+
+// Builder builds a query without parsing it from a string. It gives the same
+// query as the parser would for the equivalent string. Errors are reported by
+// Build once the query is complete.
+//
+//	Q().Field("items").Iterate().Pipe(Obj().Set("id", Q().Field("id")))
+//
+// is the same query as `.items[] | {id: .id}`.
+type Builder struct {
+	head    Query
+	path    []func(Query) Query
+	recurse bool
+	stages  []Query
+
+	keys   []string
+	fields []*Builder
+	object bool
+
+	err error
+}
+
+// Q starts a query applied to the whole document.
+func Q() *Builder {
+	var b Builder
+	return &b
+}
+
+// Obj starts an object whose fields are given by Set.
+func Obj() *Builder {
+	b := Builder{
+		object: true,
+	}
+	return &b
+}
+
+// Arr starts an array whose elements are selected by list.
+func Arr(list ...*Builder) *Builder {
+	var (
+		b  Builder
+		qs []Query
+	)
+	for _, i := range list {
+		q, err := i.Build()
+		if err != nil {
+			b.err = err
+			break
+		}
+		qs = append(qs, q)
+	}
+	b.head = Array(qs...)
+	return &b
+}
+
+// From starts from an already built query, eg Value or Sort.
+func From(q Query) *Builder {
+	b := Builder{
+		head: q,
+	}
+	return &b
+}
+
+// Field selects the value of key in an object.
+func (b *Builder) Field(key string) *Builder {
+	return b.step(func(next Query) Query {
+		return IdentNext(key, next)
+	})
+}
+
+// Keys selects the values of the given keys in an object.
+func (b *Builder) Keys(keys ...string) *Builder {
+	return b.step(func(next Query) Query {
+		return IndexNext(keys, next)
+	})
+}
+
+// Index selects the elements at the given positions in an array.
+func (b *Builder) Index(pos ...int) *Builder {
+	list := make([]string, len(pos))
+	for i := range pos {
+		list[i] = strconv.Itoa(pos[i])
+	}
+	return b.step(func(next Query) Query {
+		return IndexNext(list, next)
+	})
+}
+
+// Iterate selects all the elements of an array or all the values of an
+// object.
+func (b *Builder) Iterate() *Builder {
+	return b.step(func(next Query) Query {
+		return IndexNext(nil, next)
+	})
+}
+
+// Recurse applies the path that follows at any depth of the document. It has
+// to be the first step of a path.
+func (b *Builder) Recurse() *Builder {
+	if len(b.path) > 0 || b.head != nil || b.object {
+		return b.fail("recurse should start the path")
+	}
+	b.recurse = true
+	return b
+}
+
+// Set gives the query selecting the value of key in an object started by Obj.
+func (b *Builder) Set(key string, value *Builder) *Builder {
+	if !b.object {
+		return b.fail("%s: field set on a query that is not an object", key)
+	}
+	b.keys = append(b.keys, key)
+	b.fields = append(b.fields, value)
+	return b
+}
+
+// Pipe gives the result of the query built so far to next.
+func (b *Builder) Pipe(next *Builder) *Builder {
+	q, err := next.Build()
+	if err != nil {
+		b.err = err
+		return b
+	}
+	return b.Then(q)
+}
+
+// Then gives the result of the query built so far to q.
+func (b *Builder) Then(q Query) *Builder {
+	b.stages = append(b.stages, q)
+	return b
+}
+
+// Build gives the query or the first error found while building it.
+func (b *Builder) Build() (Query, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	stages := b.stages
+	for len(stages) > 0 && keepAll(stages[len(stages)-1]) {
+		stages = stages[:len(stages)-1]
+	}
+	if b.object {
+		var qs []Query
+		for _, f := range b.fields {
+			q, err := f.Build()
+			if err != nil {
+				return nil, err
+			}
+			qs = append(qs, q)
+		}
+		return pipe(Object(b.keys, qs), stages), nil
+	}
+	if b.head != nil {
+		return pipe(b.head, stages), nil
+	}
+	if len(b.path) == 0 {
+		if b.recurse {
+			return nil, fmt.Errorf("%w: recurse without path", errBuild)
+		}
+		if len(stages) == 0 {
+			return All(), nil
+		}
+		return pipe(stages[0], stages[1:]), nil
+	}
+	// like the parser, the pipeline replaces the last step of the path so that
+	// it is given the values selected by the path
+	var q Query
+	for i := len(b.path) - 1; i >= 0; i-- {
+		q = b.path[i](q)
+		if i == len(b.path)-1 && i > 0 {
+			q = pipe(q, stages)
+		}
+	}
+	if b.recurse {
+		q = Recurse(q)
+	}
+	if len(b.path) == 1 {
+		q = pipe(q, stages)
+	}
+	return q, nil
+}
+
+func pipe(q Query, stages []Query) Query {
+	if len(stages) == 0 {
+		return q
+	}
+	if isTransform(q) {
+		stages = append([]Query{q}, stages...)
+		q = All()
+	}
+	return PipeLine(q, stages...)
+}
+
+func (b *Builder) step(fn func(Query) Query) *Builder {
+	if b.head != nil || b.object || len(b.stages) > 0 {
+		return b.fail("path can only follow a path")
+	}
+	b.path = append(b.path, fn)
+	return b
+}
+
+func (b *Builder) fail(msg string, args ...interface{}) *Builder {
+	if b.err == nil {
+		b.err = fmt.Errorf("%w: %s", errBuild, fmt.Sprintf(msg, args...))
+	}
+	return b
+}
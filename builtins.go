@@ -0,0 +1,407 @@
+package query
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// FormatFunc transforms the JSON text of a value into the JSON text of its
+// result. It is called by the formats (@name) used in queries.
+type FormatFunc func(string) (string, error)
+
+var keywords = map[string]func() Query{
+	"add":          Add,
+	"not":          Not,
+	"to_entries":   ToEntries,
+	"from_entries": FromEntries,
+	"tojson":       ToJSON,
+	"fromjson":     FromJSON,
+	"ascii":        Ascii,
+	"unique":       Unique,
+	"sort":         Sort,
+	"first":        First,
+	"last":         Last,
+	"abs":          Abs,
+	"floor":        Floor,
+	"ceil":         Ceil,
+}
+
+var reducers = map[string]func(Query) Query{
+	"unique_by": UniqueBy,
+	"group_by":  GroupBy,
+	"sort_by":   SortBy,
+}
+
+var functions = map[string]func([]string) (Query, error){
+	"test": Test,
+	"sub":  Sub,
+	"gsub": Gsub,
+}
+
+var formats = map[string]FormatFunc{
+	"base64":  runEncodeB64,
+	"base64d": runDecodeB64,
+}
+
+// RegisterFormat makes fn available in queries as @name. It should be called
+// before any query is parsed, typically from an init function. It panics if fn
+// is nil or if a format is already registered with name.
+func RegisterFormat(name string, fn FormatFunc) {
+	if fn == nil {
+		panic("query: nil format " + name)
+	}
+	if _, ok := formats[name]; ok {
+		panic("query: format " + name + " already registered")
+	}
+	formats[name] = fn
+}
+
+func runEncodeB64(str string) (string, error) {
+	if isString(str) {
+		s, err := unquoteString(str)
+		if err != nil {
+			return "", err
+		}
+		str = s
+	}
+	return quoteString(base64.StdEncoding.EncodeToString([]byte(str))), nil
+}
+
+func runDecodeB64(str string) (string, error) {
+	if !isString(str) {
+		return "", fmt.Errorf("%s can not be decoded (string expected)", str)
+	}
+	str, err := unquoteString(str)
+	if err != nil {
+		return "", err
+	}
+	res, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return "", err
+	}
+	return quoteString(string(res)), nil
+}
+
+func runToEntries(str string) (string, error) {
+	dec := json.NewDecoder(strings.NewReader(str))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return "", fmt.Errorf("%s can not be split in entries (object expected)", str)
+	}
+	var buf strings.Builder
+	buf.WriteRune('[')
+	for i := 0; dec.More(); i++ {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return "", err
+		}
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(`{"key": `)
+		buf.WriteString(quoteString(tok.(string)))
+		buf.WriteString(`, "value": `)
+		buf.Write(value)
+		buf.WriteRune('}')
+	}
+	buf.WriteRune(']')
+	return buf.String(), nil
+}
+
+func runFromEntries(str string) (string, error) {
+	var list []map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(str), &list); err != nil {
+		return "", fmt.Errorf("%s can not be merged (array of {key, value} objects expected)", str)
+	}
+	var (
+		keys   []string
+		values = make(map[string]json.RawMessage)
+	)
+	for _, e := range list {
+		var key string
+		if err := json.Unmarshal(e["key"], &key); err != nil {
+			return "", fmt.Errorf("entry key should be a string")
+		}
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		value := e["value"]
+		if value == nil {
+			value = json.RawMessage("null")
+		}
+		values[key] = value
+	}
+	var buf strings.Builder
+	buf.WriteRune('{')
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(quoteString(k))
+		buf.WriteString(": ")
+		buf.Write(values[k])
+	}
+	buf.WriteRune('}')
+	return buf.String(), nil
+}
+
+func runNot(str string) (string, error) {
+	ok, err := getBool(str)
+	if err != nil {
+		return "", fmt.Errorf("%s can not be negated (boolean expected)", str)
+	}
+	return strconv.FormatBool(!ok), nil
+}
+
+func runToJSON(str string) (string, error) {
+	var buf strings.Builder
+	if err := Minify(strings.NewReader(str), &buf); err != nil {
+		return "", err
+	}
+	return quoteString(buf.String()), nil
+}
+
+func runFromJSON(str string) (string, error) {
+	if !isString(str) {
+		return "", fmt.Errorf("%s can not be parsed (string expected)", str)
+	}
+	str, err := unquoteString(str)
+	if err != nil {
+		return "", err
+	}
+	var (
+		q  = All()
+		rs = prepare(strings.NewReader(str))
+	)
+	err = rs.Read(q)
+	if errors.Is(err, io.EOF) {
+		err = rs.malformed("unexpected end of document")
+	}
+	if err != nil {
+		return "", err
+	}
+	return q.String(), nil
+}
+
+func runAscii(str string) (string, error) {
+	n, err := strconv.Atoi(str)
+	if err != nil || n < 0 || n > unicode.MaxASCII {
+		return "", fmt.Errorf("%s is not an ascii code point", str)
+	}
+	return quoteString(string(rune(n))), nil
+}
+
+// runAbs drops the sign of negative numbers and so keeps them as written.
+func runAbs(str string) (string, error) {
+	if _, err := parseNumber(str); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(str, "-"), nil
+}
+
+func runFloor(str string) (string, error) {
+	return roundNumber(str, math.Floor)
+}
+
+func runCeil(str string) (string, error) {
+	return roundNumber(str, math.Ceil)
+}
+
+func roundNumber(str string, round func(float64) float64) (string, error) {
+	n, err := parseNumber(str)
+	if err != nil {
+		return "", err
+	}
+	if strings.IndexAny(str, ".eE") < 0 {
+		return str, nil
+	}
+	return strconv.FormatFloat(round(n), 'f', -1, 64), nil
+}
+
+func parseNumber(str string) (float64, error) {
+	v, err := getFloat(str)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a number", str)
+	}
+	return v.(float64), nil
+}
+
+// compileRegex compiles pattern with the jq flags given. g replaces all the
+// matches and i ignores case. Other flags are not supported.
+func compileRegex(pattern, flags string) (*regexp.Regexp, bool, error) {
+	var global bool
+	for _, f := range flags {
+		switch f {
+		case 'g':
+			global = true
+		case 'i':
+			pattern = "(?i)" + pattern
+		default:
+			return nil, false, fmt.Errorf("%c: flag not supported", f)
+		}
+	}
+	re, err := regexp.Compile(pattern)
+	return re, global, err
+}
+
+func splitArray(str string) ([]string, error) {
+	dec := json.NewDecoder(strings.NewReader(str))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, fmt.Errorf("%s can not be reduced (array expected)", str)
+	}
+	var list []string
+	for dec.More() {
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		list = append(list, string(value))
+	}
+	return list, nil
+}
+
+func decodeValue(str string) (interface{}, error) {
+	rs := prepare(strings.NewReader(str))
+	return rs.Decode()
+}
+
+// compareValues orders decoded values like jq: null, false, true, numbers,
+// strings, arrays and objects. Arrays are compared element by element and
+// objects by their sorted keys first and then by their values.
+func compareValues(a, b interface{}) int {
+	if x, y := rankValue(a), rankValue(b); x != y {
+		return x - y
+	}
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			return compareInt(a, b)
+		}
+		return compareFloat(float64(a), toFloat(b))
+	case float64:
+		return compareFloat(a, toFloat(b))
+	case string:
+		return strings.Compare(a, b.(string))
+	case []interface{}:
+		other := b.([]interface{})
+		for i := 0; i < len(a) && i < len(other); i++ {
+			if c := compareValues(a[i], other[i]); c != 0 {
+				return c
+			}
+		}
+		return len(a) - len(other)
+	case map[string]interface{}:
+		other := b.(map[string]interface{})
+		keys, others := sortedKeys(a), sortedKeys(other)
+		if c := compareValues(keys, others); c != 0 {
+			return c
+		}
+		for _, k := range keys {
+			if c := compareValues(a[k.(string)], other[k.(string)]); c != 0 {
+				return c
+			}
+		}
+		return 0
+	default:
+		return 0
+	}
+}
+
+func rankValue(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case bool:
+		if v {
+			return 2
+		}
+		return 1
+	case int64, float64:
+		return 3
+	case string:
+		return 4
+	case []interface{}:
+		return 5
+	default:
+		return 6
+	}
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func toFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	default:
+		return 0
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]interface{}, len(keys))
+	for i := range keys {
+		list[i] = keys[i]
+	}
+	return list
+}
+
+func isString(str string) bool {
+	return len(str) >= 2 && jsonQuote(rune(str[0])) && jsonQuote(rune(str[len(str)-1]))
+}
+
+func unquoteString(str string) (string, error) {
+	var res string
+	if err := json.Unmarshal([]byte(str), &res); err != nil {
+		return "", err
+	}
+	return res, nil
+}
+
+func quoteString(str string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(str)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -4,9 +4,12 @@ import (
 	"encoding/base64"
 	"fmt"
 	"math"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/midbel/slices"
 	"github.com/midbel/uuid"
@@ -14,6 +17,11 @@ import (
 
 type builtinFunc func([]string) (string, error)
 
+// structured lists the builtins that give a JSON value that should not be quoted.
+var structured = map[string]bool{
+	"split": true,
+}
+
 var builtins = map[string]builtinFunc{
 	// time functions
 	"now":  checkArgs(0, true, runNow),
@@ -23,6 +31,14 @@ var builtins = map[string]builtinFunc{
 	"lower":      checkArgs(1, false, runLower),
 	"upper":      checkArgs(1, false, runUpper),
 	"title":      checkArgs(1, false, runTitle),
+	"slug":       checkArgs(1, false, runSlug),
+	"mask":       checkArgs(2, false, runMask),
+	"split":      checkArgs(2, false, runSplit),
+	"substr":     checkArgs(3, false, runSubstr),
+	"indexof":    checkArgs(2, false, runIndexOf),
+	"repeat":     checkArgs(2, false, runRepeat),
+	"matches":    checkArgs(2, false, runMatches),
+	"extract":    checkArgs(3, false, runExtract),
 	"replace":    checkArgs(3, false, runReplace),
 	"join":       checkArgs(0, true, runJoin),
 	"startswith": checkArgs(2, false, runStartsWith),
@@ -39,20 +55,26 @@ var builtins = map[string]builtinFunc{
 	"div":    checkArgs(2, true, runDiv),
 	"avg":    checkArgs(2, true, runAvg),
 	"sqrt":   checkArgs(1, false, runSqrt),
-	"min":    checkArgs(2, true, runMin),
-	"max":    checkArgs(2, true, runMax),
+	"clamp":  checkArgs(3, false, runClamp),
+	"pct":    checkArgs(2, true, runPct),
+	"min":    checkArgs(1, true, runMin),
+	"max":    checkArgs(1, true, runMax),
 	"lshift": checkArgs(2, false, runShiftLeft),
 	"rshift": checkArgs(2, false, runShiftRight),
 	// misc function
-	"len":   checkArgs(1, false, runLen),
-	"true":  checkArgs(0, false, runTrue),
-	"false": checkArgs(0, false, runFalse),
-	"if":    checkArgs(3, false, runIf),
-	"and":   checkArgs(2, false, runAnd),
-	"or":    checkArgs(2, false, runOr),
-	"any":   checkArgs(1, true, runIf),
-	"all":   checkArgs(1, true, runAll),
-	"uuid":  checkArgs(0, false, runUuid),
+	"len":     checkArgs(1, false, runLen),
+	"bool":    checkArgs(1, false, runBool),
+	"typeof":  checkArgs(1, false, runTypeof),
+	"isempty": checkArgs(1, false, runIsEmpty),
+	"isnull":  checkArgs(1, false, runIsNull),
+	"true":    checkArgs(0, false, runTrue),
+	"false":   checkArgs(0, false, runFalse),
+	"if":      checkArgs(3, false, runIf),
+	"and":     checkArgs(2, false, runAnd),
+	"or":      checkArgs(2, false, runOr),
+	"any":     checkArgs(1, true, runAny),
+	"all":     checkArgs(1, true, runAll),
+	"uuid":    checkArgs(0, false, runUuid),
 }
 
 func runNow(args []string) (string, error) {
@@ -64,6 +86,37 @@ func runTime(args []string) (string, error) {
 	return strconv.FormatInt(n.Unix(), 10), nil
 }
 
+func runBool(args []string) (string, error) {
+	return strconv.FormatBool(isTrue(slices.Fst(args))), nil
+}
+
+func runTypeof(args []string) (string, error) {
+	str := slices.Fst(args)
+	switch {
+	case str == "" || str == `""`:
+		return "empty", nil
+	case str == "null":
+		return "null", nil
+	}
+	if _, err := strconv.ParseFloat(str, 64); err == nil {
+		return TypeNumber, nil
+	}
+	if str == "true" || str == "false" {
+		return TypeBool, nil
+	}
+	return TypeString, nil
+}
+
+// runIsEmpty considers cells made only of whitespaces as empty.
+func runIsEmpty(args []string) (string, error) {
+	str := unquote(slices.Fst(args))
+	return strconv.FormatBool(strings.TrimSpace(str) == ""), nil
+}
+
+func runIsNull(args []string) (string, error) {
+	return strconv.FormatBool(slices.Fst(args) == "null"), nil
+}
+
 func runTrue(args []string) (string, error) {
 	return "true", nil
 }
@@ -156,8 +209,11 @@ func runAbs(args []string) (string, error) {
 }
 
 func runMin(args []string) (string, error) {
-	var res float64
-	for _, str := range args {
+	res, err := strconv.ParseFloat(slices.Fst(args), 64)
+	if err != nil {
+		return "", castNumberError(slices.Fst(args))
+	}
+	for _, str := range args[1:] {
 		v, err := strconv.ParseFloat(str, 64)
 		if err != nil {
 			return "", castNumberError(str)
@@ -168,8 +224,11 @@ func runMin(args []string) (string, error) {
 }
 
 func runMax(args []string) (string, error) {
-	var res float64
-	for _, str := range args {
+	res, err := strconv.ParseFloat(slices.Fst(args), 64)
+	if err != nil {
+		return "", castNumberError(slices.Fst(args))
+	}
+	for _, str := range args[1:] {
 		v, err := strconv.ParseFloat(str, 64)
 		if err != nil {
 			return "", castNumberError(str)
@@ -187,6 +246,46 @@ func runSqrt(args []string) (string, error) {
 	return strconv.FormatFloat(math.Sqrt(v), 'f', -1, 64), nil
 }
 
+func runClamp(args []string) (string, error) {
+	var vs []float64
+	for i := range args {
+		v, err := strconv.ParseFloat(args[i], 64)
+		if err != nil {
+			return "", castNumberError(args[i])
+		}
+		vs = append(vs, v)
+	}
+	if vs[1] > vs[2] {
+		return "", fmt.Errorf("%w: min (%s) greater than max (%s)", ErrArgument, args[1], args[2])
+	}
+	v := math.Max(vs[1], math.Min(vs[0], vs[2]))
+	return strconv.FormatFloat(v, 'f', -1, 64), nil
+}
+
+func runPct(args []string) (string, error) {
+	if len(args) > 3 {
+		return "", ErrArgument
+	}
+	var vs []float64
+	for i := range args {
+		v, err := strconv.ParseFloat(args[i], 64)
+		if err != nil {
+			return "", castNumberError(args[i])
+		}
+		vs = append(vs, v)
+	}
+	if vs[1] == 0 {
+		return "", ErrZero
+	}
+	prec := 2
+	if len(vs) == 3 {
+		if prec = int(vs[2]); prec < 0 {
+			return "", fmt.Errorf("%w: negative precision", ErrArgument)
+		}
+	}
+	return strconv.FormatFloat(vs[0]/vs[1]*100, 'f', prec, 64) + "%", nil
+}
+
 func runAvg(args []string) (string, error) {
 	n := len(args)
 	if n == 0 {
@@ -216,8 +315,11 @@ func runAdd(args []string) (string, error) {
 }
 
 func runSub(args []string) (string, error) {
-	var res float64
-	for i := range args {
+	res, err := strconv.ParseFloat(slices.Fst(args), 64)
+	if err != nil {
+		return "", castNumberError(slices.Fst(args))
+	}
+	for i := 1; i < len(args); i++ {
 		v, err := strconv.ParseFloat(args[i], 64)
 		if err != nil {
 			return "", castNumberError(args[i])
@@ -228,8 +330,11 @@ func runSub(args []string) (string, error) {
 }
 
 func runDiv(args []string) (string, error) {
-	var res float64
-	for i := range args {
+	res, err := strconv.ParseFloat(slices.Fst(args), 64)
+	if err != nil {
+		return "", castNumberError(slices.Fst(args))
+	}
+	for i := 1; i < len(args); i++ {
 		v, err := strconv.ParseFloat(args[i], 64)
 		if err != nil {
 			return "", castNumberError(args[i])
@@ -243,7 +348,7 @@ func runDiv(args []string) (string, error) {
 }
 
 func runMul(args []string) (string, error) {
-	var res float64
+	res := 1.0
 	for i := range args {
 		v, err := strconv.ParseFloat(args[i], 64)
 		if err != nil {
@@ -267,7 +372,176 @@ func runUpper(args []string) (string, error) {
 }
 
 func runTitle(args []string) (string, error) {
-	return strings.ToTitle(slices.Fst(args)), nil
+	var (
+		str   strings.Builder
+		start = true
+	)
+	for _, r := range slices.Fst(args) {
+		if unicode.IsSpace(r) {
+			start = true
+			str.WriteRune(r)
+			continue
+		}
+		if start {
+			r = unicode.ToTitle(r)
+		} else {
+			r = unicode.ToLower(r)
+		}
+		start = false
+		str.WriteRune(r)
+	}
+	return str.String(), nil
+}
+
+// runSlug lowercases its argument and replaces every run of characters that are
+// not letters or digits by a single hyphen. Leading and trailing hyphens are
+// removed. Accented letters are kept as is.
+func runSlug(args []string) (string, error) {
+	var (
+		str  strings.Builder
+		dash bool
+	)
+	for _, r := range unquote(slices.Fst(args)) {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			dash = str.Len() > 0
+			continue
+		}
+		if dash {
+			str.WriteRune('-')
+			dash = false
+		}
+		str.WriteRune(unicode.ToLower(r))
+	}
+	return str.String(), nil
+}
+
+// runMask replaces all the characters of its first argument by '*' except the
+// last ones. Values shorter than the number of visible characters are left
+// untouched.
+func runMask(args []string) (string, error) {
+	n, err := strconv.Atoi(slices.Lst(args))
+	if err != nil || n < 0 {
+		return "", fmt.Errorf("%w: %s is not a valid count", ErrValue, slices.Lst(args))
+	}
+	str := []rune(unquote(slices.Fst(args)))
+	if len(str) <= n {
+		return string(str), nil
+	}
+	return strings.Repeat("*", len(str)-n) + string(str[len(str)-n:]), nil
+}
+
+func runSplit(args []string) (string, error) {
+	var (
+		str  strings.Builder
+		list = strings.Split(unquote(slices.Fst(args)), unquote(slices.Lst(args)))
+	)
+	str.WriteRune('[')
+	for i := range list {
+		if i > 0 {
+			str.WriteRune(',')
+			str.WriteRune(' ')
+		}
+		str.WriteString(withQuote(list[i], true))
+	}
+	str.WriteRune(']')
+	return str.String(), nil
+}
+
+func runSubstr(args []string) (string, error) {
+	beg, err := strconv.Atoi(slices.Snd(args))
+	if err != nil || beg < 0 {
+		return "", fmt.Errorf("%w: %s is not a valid start", ErrValue, slices.Snd(args))
+	}
+	size, err := strconv.Atoi(slices.Lst(args))
+	if err != nil || size < 0 {
+		return "", fmt.Errorf("%w: %s is not a valid length", ErrValue, slices.Lst(args))
+	}
+	str := []rune(unquote(slices.Fst(args)))
+	if beg >= len(str) {
+		return "", nil
+	}
+	end := beg + size
+	if end > len(str) {
+		end = len(str)
+	}
+	return string(str[beg:end]), nil
+}
+
+func runIndexOf(args []string) (string, error) {
+	var (
+		str = unquote(slices.Fst(args))
+		ix  = strings.Index(str, unquote(slices.Lst(args)))
+	)
+	if ix > 0 {
+		ix = utf8.RuneCountInString(str[:ix])
+	}
+	return strconv.Itoa(ix), nil
+}
+
+func runRepeat(args []string) (string, error) {
+	n, err := strconv.Atoi(slices.Lst(args))
+	if err != nil || n < 0 {
+		return "", fmt.Errorf("%w: %s is not a valid count", ErrValue, slices.Lst(args))
+	}
+	return strings.Repeat(unquote(slices.Fst(args)), n), nil
+}
+
+func compilePattern(str string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(str)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid pattern %s (%s)", ErrValue, str, err)
+	}
+	return re, nil
+}
+
+// bindPattern gives the builtin name using re as its pattern instead of
+// compiling its second argument for each row. It gives nil when name does not
+// take a pattern.
+func bindPattern(name string, re *regexp.Regexp) builtinFunc {
+	switch name {
+	case "matches":
+		return checkArgs(2, false, func(args []string) (string, error) {
+			return matchPattern(re, args)
+		})
+	case "extract":
+		return checkArgs(3, false, func(args []string) (string, error) {
+			return extractPattern(re, args)
+		})
+	default:
+		return nil
+	}
+}
+
+func runMatches(args []string) (string, error) {
+	re, err := compilePattern(unquote(slices.Lst(args)))
+	if err != nil {
+		return "", err
+	}
+	return matchPattern(re, args)
+}
+
+func matchPattern(re *regexp.Regexp, args []string) (string, error) {
+	return strconv.FormatBool(re.MatchString(unquote(slices.Fst(args)))), nil
+}
+
+func runExtract(args []string) (string, error) {
+	re, err := compilePattern(unquote(slices.Snd(args)))
+	if err != nil {
+		return "", err
+	}
+	return extractPattern(re, args)
+}
+
+func extractPattern(re *regexp.Regexp, args []string) (string, error) {
+	group, err := strconv.Atoi(unquote(slices.Lst(args)))
+	if err != nil || group < 0 || group > re.NumSubexp() {
+		return "", fmt.Errorf("%w: %s is not a valid group", ErrValue, slices.Lst(args))
+	}
+	parts := re.FindStringSubmatch(unquote(slices.Fst(args)))
+	if parts == nil {
+		return "", nil
+	}
+	return parts[group], nil
 }
 
 func runReplace(args []string) (string, error) {
@@ -290,8 +564,20 @@ func runEndsWith(args []string) (string, error) {
 	return strconv.FormatBool(ok), nil
 }
 
+// runJoin joins all its arguments but the last one, the last one being used as
+// separator.
 func runJoin(args []string) (string, error) {
-	return strings.Join(slices.Slice(args), slices.Lst(args)), nil
+	if len(args) == 0 {
+		return "", nil
+	}
+	var (
+		sep  = unquote(args[len(args)-1])
+		list = make([]string, 0, len(args)-1)
+	)
+	for _, a := range args[:len(args)-1] {
+		list = append(list, unquote(a))
+	}
+	return strings.Join(list, sep), nil
 }
 
 func runEncodeB64(args []string) (string, error) {
@@ -0,0 +1,293 @@
+package comma
+
+import (
+	"errors"
+	"testing"
+)
+
+type builtinCase struct {
+	Args []string
+	Want string
+}
+
+func testBuiltin(t *testing.T, name string, data []builtinCase) {
+	t.Helper()
+	fn, ok := builtins[name]
+	if !ok {
+		t.Fatalf("%s: builtin not defined", name)
+	}
+	for _, d := range data {
+		got, err := fn(d.Args)
+		if err != nil {
+			t.Errorf("%s(%v): unexpected error: %s", name, d.Args, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%s(%v): result mismatched! want %s, got %s", name, d.Args, d.Want, got)
+		}
+	}
+}
+
+func TestBuiltinMin(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{"5", "9"}, Want: "5"},
+		{Args: []string{"9", "5", "7"}, Want: "5"},
+		{Args: []string{"-3", "-1"}, Want: "-3"},
+		{Args: []string{"-1", "-3", "-2"}, Want: "-3"},
+		{Args: []string{"42"}, Want: "42"},
+	}
+	testBuiltin(t, "min", data)
+}
+
+func TestBuiltinMax(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{"5", "9"}, Want: "9"},
+		{Args: []string{"9", "5", "7"}, Want: "9"},
+		{Args: []string{"-3", "-1"}, Want: "-1"},
+		{Args: []string{"-1", "-3", "-2"}, Want: "-1"},
+		{Args: []string{"-42"}, Want: "-42"},
+	}
+	testBuiltin(t, "max", data)
+}
+
+func TestBuiltinSub(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{"10", "3"}, Want: "7"},
+		{Args: []string{"3", "10"}, Want: "-7"},
+		{Args: []string{"10", "3", "2"}, Want: "5"},
+		{Args: []string{"-1", "-1", "-1"}, Want: "1"},
+	}
+	testBuiltin(t, "sub", data)
+}
+
+func TestBuiltinDiv(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{"10", "4"}, Want: "2.5"},
+		{Args: []string{"100", "5", "2"}, Want: "10"},
+		{Args: []string{"0", "5"}, Want: "0"},
+	}
+	testBuiltin(t, "div", data)
+
+	if _, err := builtins["div"]([]string{"10", "0"}); !errors.Is(err, ErrZero) {
+		t.Errorf("div: expected division by zero error, got %v", err)
+	}
+}
+
+func TestBuiltinMul(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{"10", "4"}, Want: "40"},
+		{Args: []string{"2", "3", "4"}, Want: "24"},
+	}
+	testBuiltin(t, "mul", data)
+}
+
+func TestBuiltinTitle(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{"foo bar"}, Want: "Foo Bar"},
+		{Args: []string{"FOO BAR"}, Want: "Foo Bar"},
+		{Args: []string{"  foo\tbar"}, Want: "  Foo\tBar"},
+		{Args: []string{"élan vital ñandú"}, Want: "Élan Vital Ñandú"},
+		{Args: []string{""}, Want: ""},
+	}
+	testBuiltin(t, "title", data)
+}
+
+func TestBuiltinAny(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{"false", "false", "true"}, Want: "true"},
+		{Args: []string{"false", "false"}, Want: "false"},
+		{Args: []string{"0", "1"}, Want: "true"},
+		{Args: []string{"false"}, Want: "false"},
+	}
+	testBuiltin(t, "any", data)
+}
+
+func TestBuiltinTypeof(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{"42"}, Want: "number"},
+		{Args: []string{"-3.5e2"}, Want: "number"},
+		{Args: []string{"true"}, Want: "bool"},
+		{Args: []string{"false"}, Want: "bool"},
+		{Args: []string{`"foobar"`}, Want: "string"},
+		{Args: []string{`"true"`}, Want: "string"},
+		{Args: []string{`""`}, Want: "empty"},
+		{Args: []string{""}, Want: "empty"},
+		{Args: []string{"null"}, Want: "null"},
+	}
+	testBuiltin(t, "typeof", data)
+}
+
+func TestBuiltinIsEmpty(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{`""`}, Want: "true"},
+		{Args: []string{""}, Want: "true"},
+		{Args: []string{`"   "`}, Want: "true"},
+		{Args: []string{`"foo"`}, Want: "false"},
+		{Args: []string{"0"}, Want: "false"},
+		{Args: []string{"null"}, Want: "false"},
+	}
+	testBuiltin(t, "isempty", data)
+}
+
+func TestBuiltinIsNull(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{"null"}, Want: "true"},
+		{Args: []string{`""`}, Want: "false"},
+		{Args: []string{`"foo"`}, Want: "false"},
+	}
+	testBuiltin(t, "isnull", data)
+}
+
+func TestBuiltinClamp(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{"-5", "0", "100"}, Want: "0"},
+		{Args: []string{"42.5", "0", "100"}, Want: "42.5"},
+		{Args: []string{"150", "0", "100"}, Want: "100"},
+		{Args: []string{"7", "7", "7"}, Want: "7"},
+	}
+	testBuiltin(t, "clamp", data)
+
+	if _, err := builtins["clamp"]([]string{"5", "10", "0"}); !errors.Is(err, ErrArgument) {
+		t.Errorf("expected argument error when min > max, got %v", err)
+	}
+	if _, err := builtins["clamp"]([]string{`"foo"`, "0", "10"}); !errors.Is(err, ErrCast) {
+		t.Errorf("expected cast error, got %v", err)
+	}
+}
+
+func TestBuiltinPct(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{"1", "4"}, Want: "25.00%"},
+		{Args: []string{"1", "3"}, Want: "33.33%"},
+		{Args: []string{"1", "3", "0"}, Want: "33%"},
+		{Args: []string{"2", "3", "4"}, Want: "66.6667%"},
+		{Args: []string{"-5", "10", "1"}, Want: "-50.0%"},
+	}
+	testBuiltin(t, "pct", data)
+
+	if _, err := builtins["pct"]([]string{"5", "0"}); !errors.Is(err, ErrZero) {
+		t.Errorf("expected division by zero error, got %v", err)
+	}
+}
+
+func TestBuiltinSlug(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{`"Hello, World!"`}, Want: "hello-world"},
+		{Args: []string{`"  multiple   spaces  here "`}, Want: "multiple-spaces-here"},
+		{Args: []string{`"--foo__bar--"`}, Want: "foo-bar"},
+		{Args: []string{`"Café Crème 2023"`}, Want: "café-crème-2023"},
+		{Args: []string{"42"}, Want: "42"},
+		{Args: []string{`"!!!"`}, Want: ""},
+	}
+	testBuiltin(t, "slug", data)
+}
+
+func TestBuiltinJoin(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{`"a"`, `"b"`, `","`}, Want: "a,b"},
+		{Args: []string{`"a"`, "1", `"b"`, `" - "`}, Want: "a - 1 - b"},
+		{Args: []string{`"a"`, `","`}, Want: "a"},
+		{Args: []string{`","`}, Want: ""},
+		{Args: []string{}, Want: ""},
+	}
+	testBuiltin(t, "join", data)
+}
+
+func TestBuiltinMask(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{"4111111111111234", "4"}, Want: "************1234"},
+		{Args: []string{`"jöhn.doe"`, "3"}, Want: "*****doe"},
+		{Args: []string{`"abc"`, "0"}, Want: "***"},
+		{Args: []string{`"abc"`, "4"}, Want: "abc"},
+	}
+	testBuiltin(t, "mask", data)
+
+	for _, n := range []string{"-1", `"x"`} {
+		if _, err := builtins["mask"]([]string{`"abc"`, n}); !errors.Is(err, ErrValue) {
+			t.Errorf("%s: expected value error, got %v", n, err)
+		}
+	}
+}
+
+func TestBuiltinSplit(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{`"a,b,c"`, `","`}, Want: `["a", "b", "c"]`},
+		{Args: []string{`"a,,1"`, `","`}, Want: `["a", "", "1"]`},
+		{Args: []string{`"abc"`, `""`}, Want: `["a", "b", "c"]`},
+		{Args: []string{`"abc"`, `";"`}, Want: `["abc"]`},
+	}
+	testBuiltin(t, "split", data)
+}
+
+func TestBuiltinSubstr(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{`"foobar"`, "0", "3"}, Want: "foo"},
+		{Args: []string{`"foobar"`, "3", "10"}, Want: "bar"},
+		{Args: []string{`"foobar"`, "10", "2"}, Want: ""},
+		{Args: []string{`"héllo"`, "1", "3"}, Want: "éll"},
+	}
+	testBuiltin(t, "substr", data)
+
+	for _, args := range [][]string{{`"foobar"`, "-1", "2"}, {`"foobar"`, `"x"`, "2"}, {`"foobar"`, "1", "-2"}} {
+		if _, err := builtins["substr"](args); !errors.Is(err, ErrValue) {
+			t.Errorf("%v: expected value error, got %v", args, err)
+		}
+	}
+	if _, err := builtins["substr"]([]string{`"foobar"`}); !errors.Is(err, ErrArgument) {
+		t.Errorf("expected argument error, got %v", err)
+	}
+}
+
+func TestBuiltinIndexOf(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{`"foobar"`, `"bar"`}, Want: "3"},
+		{Args: []string{`"héllo"`, `"l"`}, Want: "2"},
+		{Args: []string{`"foobar"`, `"baz"`}, Want: "-1"},
+		{Args: []string{`"foobar"`, `""`}, Want: "0"},
+	}
+	testBuiltin(t, "indexof", data)
+}
+
+func TestBuiltinRepeat(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{`"ab"`, "3"}, Want: "ababab"},
+		{Args: []string{`"ab"`, "0"}, Want: ""},
+	}
+	testBuiltin(t, "repeat", data)
+
+	for _, n := range []string{"-2", `"x"`} {
+		if _, err := builtins["repeat"]([]string{`"ab"`, n}); !errors.Is(err, ErrValue) {
+			t.Errorf("%s: expected value error, got %v", n, err)
+		}
+	}
+}
+
+func TestBuiltinMatches(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{`"foo123"`, `"^[a-z]+\\d+$"`}, Want: "true"},
+		{Args: []string{`"foo"`, `"\\d"`}, Want: "false"},
+		{Args: []string{"42", `"^4"`}, Want: "true"},
+	}
+	testBuiltin(t, "matches", data)
+
+	if _, err := builtins["matches"]([]string{`"foo"`, `"(foo"`}); !errors.Is(err, ErrValue) {
+		t.Errorf("expected value error for invalid pattern, got %v", err)
+	}
+}
+
+func TestBuiltinExtract(t *testing.T) {
+	data := []builtinCase{
+		{Args: []string{`"order-1234-x"`, `"(\\d+)"`, `"1"`}, Want: "1234"},
+		{Args: []string{`"john@example.com"`, `"(\\w+)@(\\w+)"`, "2"}, Want: "example"},
+		{Args: []string{`"john@example.com"`, `"(\\w+)@(\\w+)"`, "0"}, Want: "john@example"},
+		{Args: []string{`"foo"`, `"(\\d+)"`, "1"}, Want: ""},
+	}
+	testBuiltin(t, "extract", data)
+
+	if _, err := builtins["extract"]([]string{`"foo"`, `"(\\d+)"`, "2"}); !errors.Is(err, ErrValue) {
+		t.Errorf("expected value error for invalid group, got %v", err)
+	}
+	if _, err := builtins["extract"]([]string{`"foo"`, `"[a-"`, "0"}); !errors.Is(err, ErrValue) {
+		t.Errorf("expected value error for invalid pattern, got %v", err)
+	}
+}
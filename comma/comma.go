@@ -4,14 +4,126 @@ import (
 	"bufio"
 	"encoding/csv"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/rand"
+	"strconv"
 	"strings"
+	"unicode/utf8"
+)
+
+const (
+	TypeString = "string"
+	TypeNumber = "number"
+	TypeBool   = "bool"
 )
 
 type Converter struct {
-	Fields     []string
-	SkipHeader bool
-	delim      rune
+	Fields       []string
+	SkipHeader   bool
+	Offset       int
+	Limit        int
+	Sample       Sampling
+	ValidateUTF8 UTF8Policy
+	Types        map[int]string
+	BoolFormat   BoolFormat
+
+	Comment         rune
+	LazyQuotes      bool
+	FieldsPerRecord int
+	RecordSep       rune
+
+	SkipErrors bool
+	OnError    func(error)
+	NDJSON     bool
+	// KeyByRow writes the rows in an object keyed by the position of the
+	// record in the input. The header is not counted but the records skipped
+	// because of Offset or Sample are. It has no effect with NDJSON.
+	KeyByRow bool
+
+	delim rune
+}
+
+type BoolFormat int
+
+const (
+	BoolLiteral BoolFormat = iota
+	BoolNumber
+	BoolYesNo
+	BoolQuoted
+)
+
+func (f BoolFormat) format(str string) string {
+	ok := str == "true"
+	switch f {
+	case BoolNumber:
+		if ok {
+			return "1"
+		}
+		return "0"
+	case BoolYesNo:
+		if ok {
+			return strconv.Quote("yes")
+		}
+		return strconv.Quote("no")
+	case BoolQuoted:
+		return strconv.Quote(str)
+	default:
+		return str
+	}
+}
+
+type UTF8Policy int
+
+const (
+	UTF8Passthrough UTF8Policy = iota
+	UTF8Reject
+	UTF8Replace
+)
+
+func (p UTF8Policy) check(row []string) error {
+	if p == UTF8Passthrough {
+		return nil
+	}
+	for i := range row {
+		if utf8.ValidString(row[i]) {
+			continue
+		}
+		if p == UTF8Reject {
+			return fmt.Errorf("%w: column %d", ErrEncoding, i)
+		}
+		row[i] = strings.ToValidUTF8(row[i], string(utf8.RuneError))
+	}
+	return nil
+}
+
+// Sampling selects a subset of the records read by a Converter. When Every is
+// set, one record every Every records is kept. Otherwise, when Rate is set, each
+// record is kept with the given probability (0 < Rate <= 1). Seed makes
+// probabilistic sampling reproducible.
+type Sampling struct {
+	Every int
+	Rate  float64
+	Seed  int64
+}
+
+func (s Sampling) sampler() func(int) bool {
+	switch {
+	case s.Every > 1:
+		return func(i int) bool {
+			return i%s.Every == 0
+		}
+	case s.Rate > 0 && s.Rate < 1:
+		rg := rand.New(rand.NewSource(s.Seed))
+		return func(_ int) bool {
+			return rg.Float64() < s.Rate
+		}
+	default:
+		return func(_ int) bool {
+			return true
+		}
+	}
 }
 
 func Csv() *Converter {
@@ -26,6 +138,10 @@ func Space() *Converter {
 	return createConverter(' ')
 }
 
+func WithDelimiter(comma rune) *Converter {
+	return createConverter(comma)
+}
+
 func ConvertToString(r io.Reader, query string) (string, error) {
 	var str strings.Builder
 	if err := Csv().Convert(r, &str, query); err != nil {
@@ -40,44 +156,218 @@ func createConverter(comma rune) *Converter {
 	}
 }
 
+// environ holds the state shared between the rows of a conversion. prev is the
+// previously converted row - it is nil when the first row is converted and, in
+// that case, prev($N) gives 0. columns maps the names found in the header to
+// their position and header keeps the names in the order of the header. Both
+// are only set when the header is read.
+type environ struct {
+	prev    []string
+	types   map[int]string
+	bools   BoolFormat
+	columns map[string]int
+	header  []string
+}
+
+func createEnv() *environ {
+	var env environ
+	return &env
+}
+
+// render gives str as written in the output. Numbers are kept as they are in
+// the cells to be used by the operators and builtins, so the ones that are not
+// valid JSON numbers (007, .5, +3, Inf...) are only quoted here.
+func (e *environ) render(str string) string {
+	if str == "true" || str == "false" {
+		if e == nil {
+			return str
+		}
+		return e.bools.format(str)
+	}
+	if _, err := strconv.ParseFloat(str, 64); err == nil && !jsonNumber.MatchString(str) {
+		return quoteString(str)
+	}
+	return str
+}
+
+func (e *environ) format(col int, value string) (string, error) {
+	if e == nil {
+		return withQuote(value, false), nil
+	}
+	switch e.types[col] {
+	case TypeString:
+		return withQuote(value, true), nil
+	case TypeBool:
+		return strconv.FormatBool(isTrue(value)), nil
+	case TypeNumber:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+			return "", castNumberError(value)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return withQuote(value, false), nil
+	}
+}
+
 func (c Converter) Convert(r io.Reader, w io.Writer, query string) error {
-	q, err := Parse(query)
+	env := createEnv()
+	env.types = c.Types
+	env.bools = c.BoolFormat
+	q, err := parse(query, env)
 	if err != nil {
 		return err
 	}
+	if c.RecordSep != 0 && c.RecordSep != '\n' {
+		if c.RecordSep >= utf8.RuneSelf {
+			return fmt.Errorf("%w: record separator should be an ASCII character", ErrSupport)
+		}
+		r = &recordReader{
+			Reader: r,
+			sep:    byte(c.RecordSep),
+		}
+	}
 	var (
 		rs = csv.NewReader(r)
 		ws = bufio.NewWriter(w)
 	)
 	rs.TrimLeadingSpace = true
 	rs.Comma = c.delim
+	rs.Comment = c.Comment
+	rs.LazyQuotes = c.LazyQuotes
+	rs.FieldsPerRecord = c.FieldsPerRecord
 
 	if c.SkipHeader {
-		rs.Read()
+		header, err := rs.Read()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		env.columns = make(map[string]int)
+		env.header = header
+		for i, name := range header {
+			if _, ok := env.columns[name]; !ok {
+				env.columns[name] = i
+			}
+		}
+	}
+	beg, end := '[', ']'
+	if c.KeyByRow {
+		beg, end = '{', '}'
+	}
+	if !c.NDJSON {
+		ws.WriteRune(beg)
 	}
-	ws.WriteRune('[')
 
-	for i := 0; ; i++ {
+	keep := c.Sample.sampler()
+	for i, n := 0, 0; c.Limit <= 0 || n < c.Limit; i++ {
 		row, err := rs.Read()
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		// only malformed records can be skipped: other errors come from the
+		// underlying reader and would be given again by the next read
+		var perr *csv.ParseError
+		if err != nil && !errors.As(err, &perr) {
 			return err
 		}
-
-		str, err := q.Index(row)
+		if err == nil && (i < c.Offset || !keep(i-c.Offset)) {
+			continue
+		}
+		var str string
+		if err == nil {
+			str, err = c.convertRow(q, row)
+		}
 		if err != nil {
-			return err
+			record := i + 1
+			if c.SkipHeader {
+				record++
+			}
+			if err = c.rowError(record, err); err != nil {
+				return err
+			}
+			continue
 		}
-		if i > 0 {
-			ws.WriteRune(',')
-			ws.WriteRune(' ')
+		if _, ok := q.(*group); ok && (c.NDJSON || c.KeyByRow) {
+			str = "[" + str + "]"
 		}
-		ws.WriteString(str)
+		if c.NDJSON {
+			ws.WriteString(env.render(str))
+			ws.WriteRune('\n')
+		} else {
+			if n > 0 {
+				ws.WriteRune(',')
+				ws.WriteRune(' ')
+			}
+			if c.KeyByRow {
+				ws.WriteString(strconv.Quote(strconv.Itoa(i)))
+				ws.WriteRune(':')
+				ws.WriteRune(' ')
+			}
+			ws.WriteString(env.render(str))
+		}
+		env.prev = row
+		n++
+	}
+	if !c.NDJSON {
+		ws.WriteRune(end)
 	}
-	ws.WriteRune(']')
 	return ws.Flush()
+}
+
+func (c Converter) convertRow(q Indexer, row []string) (string, error) {
+	if err := c.ValidateUTF8.check(row); err != nil {
+		return "", err
+	}
+	return q.Index(row)
+}
 
+func (c Converter) rowError(record int, err error) error {
+	err = RowError{
+		Record: record,
+		Err:    err,
+	}
+	if !c.SkipErrors {
+		return err
+	}
+	if c.OnError != nil {
+		c.OnError(err)
+	}
 	return nil
 }
+
+// recordReader replaces the record separator by a newline before the input is
+// given to the csv reader. Separators found inside quoted fields are left
+// untouched.
+type recordReader struct {
+	io.Reader
+	sep    byte
+	quoted bool
+}
+
+func (r *recordReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	for i := 0; i < n; i++ {
+		switch b[i] {
+		case '"':
+			r.quoted = !r.quoted
+		case r.sep:
+			if !r.quoted {
+				b[i] = '\n'
+			}
+		}
+	}
+	return n, err
+}
+
+type RowError struct {
+	Record int
+	Err    error
+}
+
+func (e RowError) Error() string {
+	return fmt.Sprintf("record %d: %s", e.Record, e.Err)
+}
+
+func (e RowError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,716 @@
+package comma
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestConvertSample(t *testing.T) {
+	var rows []string
+	for i := 0; i < 100; i++ {
+		rows = append(rows, strconv.Itoa(i))
+	}
+	input := strings.Join(rows, "\n")
+
+	data := []struct {
+		Sample Sampling
+		Offset int
+		Limit  int
+		Want   string
+	}{
+		{
+			Sample: Sampling{Every: 25},
+			Want:   `[0, 25, 50, 75]`,
+		},
+		{
+			Sample: Sampling{Every: 25},
+			Offset: 10,
+			Want:   `[10, 35, 60, 85]`,
+		},
+		{
+			Sample: Sampling{Every: 10},
+			Offset: 5,
+			Limit:  3,
+			Want:   `[5, 15, 25]`,
+		},
+	}
+	for _, d := range data {
+		c := Csv()
+		c.Sample = d.Sample
+		c.Offset = d.Offset
+		c.Limit = d.Limit
+
+		var str strings.Builder
+		if err := c.Convert(strings.NewReader(input), &str, "$0"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+			continue
+		}
+		if got := str.String(); got != d.Want {
+			t.Errorf("result mismatched! want %s, got %s", d.Want, got)
+		}
+	}
+}
+
+func TestConvertSampleRate(t *testing.T) {
+	var rows []string
+	for i := 0; i < 1000; i++ {
+		rows = append(rows, strconv.Itoa(i))
+	}
+	input := strings.Join(rows, "\n")
+
+	convert := func(seed int64) string {
+		c := Csv()
+		c.Sample = Sampling{Rate: 0.1, Seed: seed}
+
+		var str strings.Builder
+		if err := c.Convert(strings.NewReader(input), &str, "$0"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return str.String()
+	}
+	fst, snd := convert(42), convert(42)
+	if fst != snd {
+		t.Fatalf("sampling with same seed gives different results")
+	}
+	n := strings.Count(fst, ",") + 1
+	if n < 50 || n > 150 {
+		t.Errorf("unexpected number of sampled rows: %d", n)
+	}
+}
+
+func TestConvertValidateUTF8(t *testing.T) {
+	input := "foo,\xffbar\xfe\n"
+	data := []struct {
+		Policy UTF8Policy
+		Want   string
+		Fail   bool
+	}{
+		{
+			Policy: UTF8Passthrough,
+			Want:   "[[\"foo\", \"\xffbar\xfe\"]]",
+		},
+		{
+			Policy: UTF8Replace,
+			Want:   "[[\"foo\", \"\ufffdbar\ufffd\"]]",
+		},
+		{
+			Policy: UTF8Reject,
+			Fail:   true,
+		},
+	}
+	for _, d := range data {
+		c := Csv()
+		c.ValidateUTF8 = d.Policy
+
+		var str strings.Builder
+		err := c.Convert(strings.NewReader(input), &str, "[$0, $1]")
+		if d.Fail {
+			if !errors.Is(err, ErrEncoding) {
+				t.Errorf("expected encoding error, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			continue
+		}
+		if got := str.String(); got != d.Want {
+			t.Errorf("result mismatched! want %s, got %s", d.Want, got)
+		}
+	}
+}
+
+func TestConvertPrev(t *testing.T) {
+	input := "a,10\nb,15\nc,12\nd,20\n"
+	want := `[{"name": "a", "delta": 10}, {"name": "b", "delta": 5}, {"name": "c", "delta": -3}, {"name": "d", "delta": 8}]`
+
+	got, err := ConvertToString(strings.NewReader(input), "{name: $0, delta: $1 - prev($1)}")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+}
+
+func TestConvertTypes(t *testing.T) {
+	input := "007,42,1,yes\n010,3.5,0,no\n"
+	want := `[["007", 42, true, "yes"], ["010", 3.5, false, "no"]]`
+
+	c := Csv()
+	c.Types = map[int]string{
+		0: TypeString,
+		1: TypeNumber,
+		2: TypeBool,
+	}
+	var str strings.Builder
+	if err := c.Convert(strings.NewReader(input), &str, "$0..$3"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := str.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+
+	str.Reset()
+	c.Types = map[int]string{
+		3: TypeNumber,
+	}
+	if err := c.Convert(strings.NewReader(input), &str, "$3"); !errors.Is(err, ErrCast) {
+		t.Errorf("expected cast error, got %v", err)
+	}
+
+	str.Reset()
+	c.Types = map[int]string{
+		0: TypeNumber,
+	}
+	if err := c.Convert(strings.NewReader("007\n.5\n+3\n1e2\n"), &str, "$0"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := str.String(), `[7, 0.5, 3, 100]`; got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+	for _, value := range []string{"Inf", "-inf", "NaN", "1e400"} {
+		str.Reset()
+		err := c.Convert(strings.NewReader(value+"\n"), &str, "$0")
+		if !errors.Is(err, ErrCast) {
+			t.Errorf("%s: expected cast error, got %v", value, err)
+		}
+	}
+}
+
+func TestConvertCumulative(t *testing.T) {
+	input := "a,10\nb,5\nc,15\nd,10\n"
+	data := []struct {
+		Query string
+		Want  string
+	}{
+		{
+			Query: "cumsum($1)",
+			Want:  `[10, 15, 30, 40]`,
+		},
+		{
+			Query: "cumavg($1)",
+			Want:  `[10, 7.5, 10, 10]`,
+		},
+		{
+			Query: "cumcount($0)",
+			Want:  `[1, 2, 3, 4]`,
+		},
+		{
+			Query: "[$0, cumsum($1 * 2)]",
+			Want:  `[["a", 20], ["b", 30], ["c", 60], ["d", 80]]`,
+		},
+	}
+	for _, d := range data {
+		got, err := ConvertToString(strings.NewReader(input), d.Query)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%s: result mismatched! want %s, got %s", d.Query, d.Want, got)
+		}
+	}
+}
+
+func TestConvertBoolFormat(t *testing.T) {
+	input := "foo,true,1\nbar,false,0\n"
+	data := []struct {
+		Format BoolFormat
+		Want   string
+	}{
+		{
+			Format: BoolLiteral,
+			Want:   `[{"name": "foo", "active": true, "valid": true}, {"name": "bar", "active": false, "valid": false}]`,
+		},
+		{
+			Format: BoolNumber,
+			Want:   `[{"name": "foo", "active": 1, "valid": 1}, {"name": "bar", "active": 0, "valid": 0}]`,
+		},
+		{
+			Format: BoolYesNo,
+			Want:   `[{"name": "foo", "active": "yes", "valid": "yes"}, {"name": "bar", "active": "no", "valid": "no"}]`,
+		},
+		{
+			Format: BoolQuoted,
+			Want:   `[{"name": "foo", "active": "true", "valid": "true"}, {"name": "bar", "active": "false", "valid": "false"}]`,
+		},
+	}
+	for _, d := range data {
+		c := Csv()
+		c.BoolFormat = d.Format
+
+		var str strings.Builder
+		if err := c.Convert(strings.NewReader(input), &str, "{name: $0, active: $1, valid: bool($2)}"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+			continue
+		}
+		if got := str.String(); got != d.Want {
+			t.Errorf("result mismatched! want %s, got %s", d.Want, got)
+		}
+	}
+}
+
+func TestConvertReaderOptions(t *testing.T) {
+	input := "# exported data\nfoo,bar \"baz\"\n# comment\nqux,quux\n"
+
+	c := Csv()
+	c.Comment = '#'
+	c.LazyQuotes = true
+
+	var str strings.Builder
+	if err := c.Convert(strings.NewReader(input), &str, "$1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `["bar \"baz\"", "quux"]`
+	if got := str.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+
+	c = Csv()
+	c.FieldsPerRecord = 3
+	if err := c.Convert(strings.NewReader("foo,bar\n"), &str, "$0"); err == nil {
+		t.Errorf("expected error with wrong number of fields")
+	}
+}
+
+func TestConvertDelimiter(t *testing.T) {
+	input := "foo;\"bar;baz\";1\n# comment\nqux;quux;2\n"
+
+	c := WithDelimiter(';')
+	c.Comment = '#'
+
+	var str strings.Builder
+	if err := c.Convert(strings.NewReader(input), &str, "[$0, $1, $2]"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `[["foo", "bar;baz", 1], ["qux", "quux", 2]]`
+	if got := str.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+
+	str.Reset()
+	if err := WithDelimiter('|').FromJSON(strings.NewReader(`{"a": "x|y", "b": 1}`), &str, []string{"a", "b"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "\"x|y\"|1\n"; str.String() != want {
+		t.Errorf("result mismatched! want %q, got %q", want, str.String())
+	}
+}
+
+func TestConvertNDJSON(t *testing.T) {
+	input := "foo,1\nbar,2\n"
+	data := []struct {
+		Query string
+		Want  string
+	}{
+		{
+			Query: `{name: $0, score: $1}`,
+			Want:  "{\"name\": \"foo\", \"score\": 1}\n{\"name\": \"bar\", \"score\": 2}\n",
+		},
+		{
+			Query: `$0, $1 > 1`,
+			Want:  "[\"foo\", false]\n[\"bar\", true]\n",
+		},
+		{
+			Query: `$1`,
+			Want:  "1\n2\n",
+		},
+	}
+	for _, d := range data {
+		c := Csv()
+		c.NDJSON = true
+
+		var str strings.Builder
+		if err := c.Convert(strings.NewReader(input), &str, d.Query); err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if got := str.String(); got != d.Want {
+			t.Errorf("%s: result mismatched! want %q, got %q", d.Query, d.Want, got)
+		}
+	}
+}
+
+func TestConvertRecordSep(t *testing.T) {
+	input := `foo,1;bar,2;"baz;qux",3;`
+
+	c := Csv()
+	c.RecordSep = ';'
+
+	var str strings.Builder
+	if err := c.Convert(strings.NewReader(input), &str, "[$0, $1]"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `[["foo", 1], ["bar", 2], ["baz;qux", 3]]`
+	if got := str.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+
+	str.Reset()
+	c = Tsv()
+	c.RecordSep = '\x1e'
+	if err := c.Convert(strings.NewReader("foo\t1\x1ebar\t2"), &str, "$0"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := `["foo", "bar"]`; str.String() != want {
+		t.Errorf("result mismatched! want %s, got %s", want, str.String())
+	}
+}
+
+func TestConvertKeyByRow(t *testing.T) {
+	input := "name,score\nfoo,1\nbar,2\nbaz,3\n"
+	data := []struct {
+		Query  string
+		Offset int
+		Want   string
+	}{
+		{
+			Query: `{name: $0, score: $1}`,
+			Want:  `{"0": {"name": "foo", "score": 1}, "1": {"name": "bar", "score": 2}, "2": {"name": "baz", "score": 3}}`,
+		},
+		{
+			Query:  `$0, $1`,
+			Offset: 1,
+			Want:   `{"1": ["bar", 2], "2": ["baz", 3]}`,
+		},
+	}
+	for _, d := range data {
+		c := Csv()
+		c.SkipHeader = true
+		c.KeyByRow = true
+		c.Offset = d.Offset
+
+		var str strings.Builder
+		if err := c.Convert(strings.NewReader(input), &str, d.Query); err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if got := str.String(); got != d.Want {
+			t.Errorf("%s: result mismatched! want %s, got %s", d.Query, d.Want, got)
+		}
+	}
+}
+
+func TestConvertDefault(t *testing.T) {
+	input := "foo,1,x\nbar\nbaz,2\n"
+
+	c := Csv()
+	c.FieldsPerRecord = -1
+
+	var str strings.Builder
+	if err := c.Convert(strings.NewReader(input), &str, `[$0, $1 ?? 0, $2 ?? "N/A"]`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `[["foo", 1, "x"], ["bar", 0, "N/A"], ["baz", 2, "N/A"]]`
+	if got := str.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+}
+
+func TestConvertNested(t *testing.T) {
+	input := "foo,1,2.5,\"x,y\"\n"
+	data := []struct {
+		Query string
+		Want  string
+	}{
+		{
+			Query: `{user: {name: $0, id: $1}, scores: [$2, $3]}`,
+			Want:  `[{"user": {"name": "foo", "id": 1}, "scores": [2.5, "x,y"]}]`,
+		},
+		{
+			Query: `[[$0, [$1, {a: {b: [$2]}}]], {}]`,
+			Want:  `[[["foo", [1, {"a": {"b": [2.5]}}]], {}]]`,
+		},
+		{
+			Query: `{a: [$1..$3], b: {c: $0..$1}}`,
+			Want:  `[{"a": [1, 2.5, "x,y"], "b": {"c": ["foo", 1]}}]`,
+		},
+		{
+			Query: `{a: {b: $2 > $1, c: [$1 == 0, {d: $3}]}}`,
+			Want:  `[{"a": {"b": "true", "c": ["false", {"d": "x,y"}]}}]`,
+		},
+	}
+	for _, d := range data {
+		c := Csv()
+		c.BoolFormat = BoolQuoted
+
+		var str strings.Builder
+		if err := c.Convert(strings.NewReader(input), &str, d.Query); err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if got := str.String(); got != d.Want {
+			t.Errorf("%s: result mismatched! want %s, got %s", d.Query, d.Want, got)
+		}
+	}
+}
+
+func TestConvertHeader(t *testing.T) {
+	input := "name,score,team\nfoo,10,red\nbar,5,blue\n"
+
+	c := Csv()
+	c.SkipHeader = true
+
+	var str strings.Builder
+	if err := c.Convert(strings.NewReader(input), &str, `{user: $name, total: $score * 2, team: $2}`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `[{"user": "foo", "total": 20, "team": "red"}, {"user": "bar", "total": 10, "team": "blue"}]`
+	if got := str.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+
+	str.Reset()
+	if err := c.Convert(strings.NewReader(input), &str, `{user: $name, all: [$name..$team], pair: $1..$name}`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want = `[{"user": "foo", "all": ["foo", 10, "red"], "pair": ["foo", 10]}, {"user": "bar", "all": ["bar", 5, "blue"], "pair": ["bar", 5]}]`
+	if got := str.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+
+	str.Reset()
+	err := c.Convert(strings.NewReader(input), &str, `$age`)
+	if !errors.Is(err, ErrColumn) {
+		t.Errorf("expected missing column error, got %v", err)
+	}
+
+	str.Reset()
+	err = c.Convert(strings.NewReader(input), &str, `$name..$age`)
+	if !errors.Is(err, ErrColumn) {
+		t.Errorf("expected missing column error, got %v", err)
+	}
+
+	str.Reset()
+	c.SkipHeader = false
+	err = c.Convert(strings.NewReader(input), &str, `$name`)
+	if !errors.Is(err, ErrColumn) {
+		t.Errorf("expected missing column error without header, got %v", err)
+	}
+
+	str.Reset()
+	err = c.Convert(strings.NewReader(input), &str, `$0..$team`)
+	if !errors.Is(err, ErrColumn) {
+		t.Errorf("expected missing column error without header, got %v", err)
+	}
+}
+
+func TestConvertObject(t *testing.T) {
+	input := "name,score,active\nfoo,10,true\nbar\nbaz,5,false,extra\n"
+
+	c := Csv()
+	c.SkipHeader = true
+	c.FieldsPerRecord = -1
+
+	var str strings.Builder
+	if err := c.Convert(strings.NewReader(input), &str, `@object`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `[{"name": "foo", "score": 10, "active": true}, {"name": "bar", "score": null, "active": null}, {"name": "baz", "score": 5, "active": false, "3": "extra"}]`
+	if got := str.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+
+	str.Reset()
+	c.Types = map[int]string{2: TypeString}
+	if err := c.Convert(strings.NewReader("id,id,code\n1,2,007\n"), &str, `@object`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want = `[{"id": 1, "code": "007"}]`
+	if got := str.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+
+	str.Reset()
+	c.SkipHeader = false
+	err := c.Convert(strings.NewReader(input), &str, `@object`)
+	if !errors.Is(err, ErrColumn) {
+		t.Errorf("expected missing header error, got %v", err)
+	}
+}
+
+func TestConvertQuote(t *testing.T) {
+	data := []struct {
+		Cell string
+		Want string
+	}{
+		{Cell: "foo\tbar", Want: `"foo\tbar"`},
+		{Cell: "a \"quoted\" word", Want: `"a \"quoted\" word"`},
+		{Cell: "back\\slash/slash", Want: `"back\\slash/slash"`},
+		{Cell: "bell\x07\x00\x1f", Want: `"bell\u0007\u0000\u001f"`},
+		{Cell: "line\r\nfeed\f\b", Want: `"line\r\nfeed\f\b"`},
+		{Cell: "π 😀 \u007f", Want: "\"π 😀 \u007f\""},
+		{Cell: `"ok"`, Want: `"ok"`},
+		{Cell: `"a"b"`, Want: `"\"a\"b\""`},
+		{Cell: "007", Want: `"007"`},
+		{Cell: "0x10", Want: `"0x10"`},
+		{Cell: "Inf", Want: `"Inf"`},
+		{Cell: ".5", Want: `".5"`},
+		{Cell: "-1.5e3", Want: `-1.5e3`},
+	}
+	var env *environ
+	for _, d := range data {
+		got := env.render(withQuote(d.Cell, false))
+		if got != d.Want {
+			t.Errorf("%q: result mismatched! want %s, got %s", d.Cell, d.Want, got)
+		}
+		if !json.Valid([]byte(got)) {
+			t.Errorf("%q: invalid JSON string %s", d.Cell, got)
+		}
+	}
+
+	input := "\"tab\there\",\"say \"\"hi\"\"\"\n"
+	var str strings.Builder
+	if err := Csv().Convert(strings.NewReader(input), &str, `{a: $0, b: [$1, "x"]}`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `[{"a": "tab\there", "b": ["say \"hi\"", "x"]}]`
+	if got := str.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+
+	str.Reset()
+	query := `$0 + 1, $0 * 2, $0 == 7, $1 * 4, $1 < 1, [$0, $1], {a: $0}`
+	if err := Csv().Convert(strings.NewReader("007,.5\n"), &str, query); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want = `[8, 14, true, 2, true, ["007", ".5"], {"a": "007"}]`
+	if got := str.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+}
+
+func TestConvertEmptyField(t *testing.T) {
+	input := "foo,1,\nbar,,x\n"
+
+	var str strings.Builder
+	if err := Csv().Convert(strings.NewReader(input), &str, `[$0, $1, $2]`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `[["foo", 1, ""], ["bar", "", "x"]]`
+	if got := str.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+}
+
+func TestConvertRowError(t *testing.T) {
+	input := "name,score\nfoo,10\nbar,abc\nbaz,5\n"
+	query := "{name: $0, score: $1 * 2}"
+
+	c := Csv()
+	c.SkipHeader = true
+
+	var str strings.Builder
+	err := c.Convert(strings.NewReader(input), &str, query)
+
+	var rerr RowError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("expected RowError, got %v", err)
+	}
+	if rerr.Record != 3 {
+		t.Errorf("record number mismatched! want 3, got %d", rerr.Record)
+	}
+
+	var skipped []error
+	c.SkipErrors = true
+	c.OnError = func(err error) {
+		skipped = append(skipped, err)
+	}
+	str.Reset()
+	if err := c.Convert(strings.NewReader(input), &str, query); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `[{"name": "foo", "score": 20}, {"name": "baz", "score": 10}]`
+	if got := str.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+	if len(skipped) != 1 {
+		t.Errorf("expected 1 skipped row, got %d", len(skipped))
+	}
+
+	str.Reset()
+	skipped = skipped[:0]
+	broken := io.MultiReader(strings.NewReader("name,score\nfoo,10\n"), failingReader{})
+	err = c.Convert(broken, &str, query)
+	if !errors.Is(err, errBroken) {
+		t.Errorf("expected read error, got %v", err)
+	}
+	if len(skipped) != 0 {
+		t.Errorf("expected no skipped row, got %d", len(skipped))
+	}
+}
+
+var errBroken = errors.New("disk gone")
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errBroken
+}
+
+func TestFromJSON(t *testing.T) {
+	data := []struct {
+		Input  string
+		Fields []string
+		Header []string
+		Want   string
+	}{
+		{
+			Input:  `[{"name": "foo", "score": 10, "active": true}, {"name": "bar, baz", "active": false}]`,
+			Fields: []string{"name", "score", "active"},
+			Header: []string{"user", "score", "active"},
+			Want:   "user,score,active\nfoo,10,true\n\"bar, baz\",,false\n",
+		},
+		{
+			Input:  "{\"name\": \"foo\", \"tags\": [\"a\", \"b\"]}\n{\"name\": null}\n",
+			Fields: []string{"name", "tags"},
+			Want:   "foo,\"[\"\"a\"\",\"\"b\"\"]\"\n,\n",
+		},
+		{
+			Input: `[["foo", 1], ["bar", 2.5, "x"]]`,
+			Want:  "foo,1\nbar,2.5,x\n",
+		},
+		{
+			Input:  `[["foo", 1], ["bar", 2.5, "x"]]`,
+			Fields: []string{"2", "0"},
+			Want:   ",foo\nx,bar\n",
+		},
+		{
+			Input:  `{"name": "foo", "score": 10}`,
+			Header: []string{"score", "name"},
+			Want:   "score,name\n10,foo\n",
+		},
+	}
+	for _, d := range data {
+		c := Csv()
+		c.Fields = d.Header
+
+		var str strings.Builder
+		if err := c.FromJSON(strings.NewReader(d.Input), &str, d.Fields); err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Input, err)
+			continue
+		}
+		if got := str.String(); got != d.Want {
+			t.Errorf("%s: result mismatched! want %q, got %q", d.Input, d.Want, got)
+		}
+	}
+
+	var str strings.Builder
+	if err := Tsv().FromJSON(strings.NewReader(`{"a": 1, "b": "x"}`), &str, []string{"b", "a"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "x\t1\n"; str.String() != want {
+		t.Errorf("result mismatched! want %q, got %q", want, str.String())
+	}
+	if err := Csv().FromJSON(strings.NewReader(`42`), &str, nil); err == nil {
+		t.Errorf("expected error for scalar row")
+	}
+	if err := Csv().FromJSON(strings.NewReader(`{"a": 1}`), &str, nil); !errors.Is(err, ErrSupport) {
+		t.Errorf("expected error for object row without fields, got %v", err)
+	}
+}
@@ -1,9 +1,11 @@
 package comma
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -13,7 +15,10 @@ var (
 	ErrSupport  = errors.New("unsupported operation")
 	ErrZero     = errors.New("division by zero")
 	ErrArgument = errors.New("invalid number of arguments given")
+	ErrValue    = errors.New("invalid argument value")
 	ErrCast     = errors.New("cast error")
+	ErrEncoding = errors.New("invalid UTF-8 sequence")
+	ErrColumn   = errors.New("column not found")
 )
 
 type Indexer interface {
@@ -23,6 +28,8 @@ type Indexer interface {
 type call struct {
 	name string
 	args []Indexer
+	// fn, when set, is used instead of the builtin registered under name
+	fn builtinFunc
 }
 
 func (c *call) Index(row []string) (string, error) {
@@ -34,17 +41,69 @@ func (c *call) Index(row []string) (string, error) {
 		}
 		args = append(args, got)
 	}
-	fn, ok := builtins[c.name]
+	fn, ok := c.fn, c.fn != nil
 	if !ok {
-		return "", fmt.Errorf("%s: function not defined")
+		fn, ok = builtins[c.name]
+	}
+	if !ok {
+		return "", fmt.Errorf("%s: function not defined", c.name)
 	}
 	str, err := fn(args)
 	if err != nil {
 		return "", fmt.Errorf("%s: %w", c.name, err)
 	}
+	if structured[c.name] {
+		return str, nil
+	}
 	return withQuote(str, false), nil
 }
 
+// cumulative computes a running aggregate (cumsum, cumavg, cumcount) of its
+// argument. Its state is kept for the whole conversion and is never reset: the
+// value computed for a row takes into account all the rows converted before it.
+type cumulative struct {
+	name  string
+	arg   Indexer
+	sum   float64
+	count int
+}
+
+func (c *cumulative) Index(row []string) (string, error) {
+	got, err := c.arg.Index(row)
+	if err != nil {
+		return "", err
+	}
+	if c.name == "cumcount" {
+		if got != "" && got != `""` {
+			c.count++
+		}
+		return strconv.Itoa(c.count), nil
+	}
+	v, err := strconv.ParseFloat(got, 64)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", c.name, castNumberError(got))
+	}
+	c.sum += v
+	c.count++
+	if c.name == "cumavg" {
+		return strconv.FormatFloat(c.sum/float64(c.count), 'f', -1, 64), nil
+	}
+	return strconv.FormatFloat(c.sum, 'f', -1, 64), nil
+}
+
+type defaulted struct {
+	left  Indexer
+	right Indexer
+}
+
+func (d *defaulted) Index(row []string) (string, error) {
+	got, err := d.left.Index(row)
+	if err == nil && got != "" && got != `""` {
+		return got, nil
+	}
+	return d.right.Index(row)
+}
+
 type ternary struct {
 	cdt Indexer
 	csq Indexer
@@ -62,6 +121,54 @@ func (t *ternary) Index(row []string) (string, error) {
 	return t.alt.Index(row)
 }
 
+type compare struct {
+	left  Indexer
+	right Indexer
+	op    rune
+}
+
+func (c *compare) Index(row []string) (string, error) {
+	left, err := c.left.Index(row)
+	if err != nil {
+		return "", err
+	}
+	right, err := c.right.Index(row)
+	if err != nil {
+		return "", err
+	}
+	var cmp int
+	x, err1 := strconv.ParseFloat(left, 64)
+	y, err2 := strconv.ParseFloat(right, 64)
+	if err1 == nil && err2 == nil {
+		switch {
+		case x < y:
+			cmp = -1
+		case x > y:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(unquote(left), unquote(right))
+	}
+	var ok bool
+	switch c.op {
+	case Lt:
+		ok = cmp < 0
+	case Le:
+		ok = cmp <= 0
+	case Gt:
+		ok = cmp > 0
+	case Ge:
+		ok = cmp >= 0
+	case Eq:
+		ok = cmp == 0
+	case Ne:
+		ok = cmp != 0
+	default:
+		return "", ErrSupport
+	}
+	return strconv.FormatBool(ok), nil
+}
+
 type binary struct {
 	left  Indexer
 	right Indexer
@@ -92,6 +199,11 @@ func (b *binary) Index(row []string) (string, error) {
 				return 0, ErrZero
 			}
 			left /= right
+		case FloorDiv:
+			if right == 0 {
+				return 0, ErrZero
+			}
+			left = math.Floor(left / right)
 		case Mod:
 			if right == 0 {
 				return 0, ErrZero
@@ -130,6 +242,7 @@ func (u *unary) Index(row []string) (string, error) {
 
 type group struct {
 	list []Indexer
+	env  *environ
 }
 
 func (g *group) Index(row []string) (string, error) {
@@ -144,7 +257,7 @@ func (g *group) Index(row []string) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		str.WriteString(got)
+		str.WriteString(g.env.render(got))
 	}
 	return str.String(), nil
 }
@@ -152,6 +265,7 @@ func (g *group) Index(row []string) (string, error) {
 type object struct {
 	fields map[string]Indexer
 	keys   []string
+	env    *environ
 }
 
 func (o *object) Index(row []string) (string, error) {
@@ -171,7 +285,57 @@ func (o *object) Index(row []string) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		str.WriteString(val)
+		str.WriteString(o.env.render(val))
+	}
+	str.WriteRune('}')
+	return str.String(), nil
+}
+
+// record builds an object from a row keyed by the names of the header. The
+// columns missing from the row are null and the columns beyond the header are
+// keyed by their position. A name given to more than one column is only used
+// for the first one.
+type record struct {
+	env *environ
+}
+
+func (r *record) Index(row []string) (string, error) {
+	if r.env == nil || r.env.columns == nil {
+		return "", fmt.Errorf("@object: %w (no header available)", ErrColumn)
+	}
+	var (
+		str  strings.Builder
+		size = len(row)
+	)
+	if n := len(r.env.header); n > size {
+		size = n
+	}
+	str.WriteRune('{')
+	for i, n := 0, 0; i < size; i++ {
+		key := strconv.Itoa(i)
+		if i < len(r.env.header) {
+			key = r.env.header[i]
+			if r.env.columns[key] != i {
+				continue
+			}
+		}
+		if n > 0 {
+			str.WriteRune(',')
+			str.WriteRune(' ')
+		}
+		n++
+		str.WriteString(withQuote(key, true))
+		str.WriteRune(':')
+		str.WriteRune(' ')
+		if i >= len(row) {
+			str.WriteString("null")
+			continue
+		}
+		val, err := r.env.format(i, row[i])
+		if err != nil {
+			return "", err
+		}
+		str.WriteString(r.env.render(val))
 	}
 	str.WriteRune('}')
 	return str.String(), nil
@@ -179,6 +343,7 @@ func (o *object) Index(row []string) (string, error) {
 
 type array struct {
 	list []Indexer
+	env  *environ
 }
 
 func (a *array) Index(row []string) (string, error) {
@@ -193,7 +358,7 @@ func (a *array) Index(row []string) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		str.WriteString(got)
+		str.WriteString(a.env.render(got))
 	}
 	str.WriteRune(']')
 	return str.String(), nil
@@ -201,6 +366,7 @@ func (a *array) Index(row []string) (string, error) {
 
 type set struct {
 	index []Indexer
+	env   *environ
 }
 
 func (i *set) Index(row []string) (string, error) {
@@ -215,7 +381,7 @@ func (i *set) Index(row []string) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		str.WriteString(got)
+		str.WriteString(i.env.render(got))
 	}
 	str.WriteRune(']')
 	return str.String(), nil
@@ -223,41 +389,112 @@ func (i *set) Index(row []string) (string, error) {
 
 type index struct {
 	index int
+	env   *environ
 }
 
 func (i *index) Index(row []string) (string, error) {
-	if i.index < 0 || i.index >= len(row) {
+	n := i.index
+	if n < 0 {
+		n += len(row)
+	}
+	if n < 0 || n >= len(row) {
+		return "", ErrIndex
+	}
+	return i.env.format(n, row[n])
+}
+
+type column struct {
+	name string
+	env  *environ
+}
+
+func (c *column) Index(row []string) (string, error) {
+	if c.env == nil || c.env.columns == nil {
+		return "", fmt.Errorf("$%s: %w (no header available)", c.name, ErrColumn)
+	}
+	i, ok := c.env.columns[c.name]
+	if !ok {
+		return "", fmt.Errorf("$%s: %w", c.name, ErrColumn)
+	}
+	if i >= len(row) {
 		return "", ErrIndex
 	}
-	return withQuote(row[i.index], false), nil
+	return c.env.format(i, row[i])
 }
 
+type previous struct {
+	index int
+	env   *environ
+}
+
+func (p *previous) Index(row []string) (string, error) {
+	if p.env.prev == nil {
+		return "0", nil
+	}
+	if p.index < 0 || p.index >= len(p.env.prev) {
+		return "", ErrIndex
+	}
+	return withQuote(p.env.prev[p.index], false), nil
+}
+
+// interval selects the columns between two positions. A position given by the
+// name of a column in the header (from, to) is resolved when a row is indexed.
 type interval struct {
 	beg  int
 	end  int
+	from string
+	to   string
 	add  bool
 	flat bool
+	env  *environ
 }
 
 func (i *interval) Index(row []string) (string, error) {
-	if i.end < i.beg {
-		i.beg, i.end = i.end, i.beg
+	beg, end, err := i.bounds(row)
+	if err != nil {
+		return "", err
 	}
-	if i.beg < 0 || i.beg > len(row) {
-		return "", ErrIndex
+	if !i.add {
+		return i.asArray(row, beg, end)
 	}
-	if i.end < 0 || i.end > len(row) {
-		return "", ErrIndex
+	return i.asValue(row, beg, end)
+}
+
+func (i *interval) bounds(row []string) (int, int, error) {
+	beg, err := i.position(i.beg, i.from)
+	if err != nil {
+		return 0, 0, err
 	}
-	if !i.add {
-		return i.asArray(row)
+	end, err := i.position(i.end, i.to)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end < beg {
+		beg, end = end, beg
 	}
-	return i.asValue(row)
+	if beg < 0 || end >= len(row) {
+		return 0, 0, ErrIndex
+	}
+	return beg, end, nil
+}
+
+func (i *interval) position(pos int, name string) (int, error) {
+	if name == "" {
+		return pos, nil
+	}
+	if i.env == nil || i.env.columns == nil {
+		return 0, fmt.Errorf("$%s: %w (no header available)", name, ErrColumn)
+	}
+	pos, ok := i.env.columns[name]
+	if !ok {
+		return 0, fmt.Errorf("$%s: %w", name, ErrColumn)
+	}
+	return pos, nil
 }
 
-func (i *interval) asValue(row []string) (string, error) {
+func (i *interval) asValue(row []string, beg, end int) (string, error) {
 	var res float64
-	for _, str := range row[i.beg : i.end+1] {
+	for _, str := range row[beg : end+1] {
 		v, err := strconv.ParseFloat(str, 64)
 		if err != nil {
 			return "", err
@@ -267,25 +504,85 @@ func (i *interval) asValue(row []string) (string, error) {
 	return strconv.FormatFloat(res, 'f', -1, 64), nil
 }
 
-func (i *interval) asArray(row []string) (string, error) {
-	var (
-		str strings.Builder
-		pos int
-	)
+func (i *interval) asArray(row []string, beg, end int) (string, error) {
+	values, err := i.collect(row, beg, end)
+	if err != nil {
+		return "", err
+	}
+	var str strings.Builder
 	if !i.flat {
 		str.WriteRune('[')
 	}
-	for j := i.beg; j <= i.end; j++ {
-		if pos > 0 {
+	str.WriteString(strings.Join(values, ", "))
+	if !i.flat {
+		str.WriteRune(']')
+	}
+	return str.String(), nil
+}
+
+func (i *interval) values(row []string) ([]string, error) {
+	beg, end, err := i.bounds(row)
+	if err != nil {
+		return nil, err
+	}
+	return i.collect(row, beg, end)
+}
+
+func (i *interval) collect(row []string, beg, end int) ([]string, error) {
+	var list []string
+	for j := beg; j <= end; j++ {
+		val, err := i.env.format(j, row[j])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, i.env.render(val))
+	}
+	return list, nil
+}
+
+// zip pairs the columns of two intervals. Each pair is an array or an object
+// when keys are given. The result is as long as the shortest interval.
+type zip struct {
+	left  *interval
+	right *interval
+	keys  []string
+}
+
+func (z *zip) Index(row []string) (string, error) {
+	left, err := z.left.values(row)
+	if err != nil {
+		return "", err
+	}
+	right, err := z.right.values(row)
+	if err != nil {
+		return "", err
+	}
+	var str strings.Builder
+	str.WriteRune('[')
+	for i := 0; i < len(left) && i < len(right); i++ {
+		if i > 0 {
 			str.WriteRune(',')
 			str.WriteRune(' ')
 		}
-		pos++
-		str.WriteString(withQuote(row[j], false))
-	}
-	if !i.flat {
-		str.WriteRune(']')
+		if len(z.keys) == 0 {
+			str.WriteRune('[')
+			str.WriteString(left[i])
+			str.WriteString(", ")
+			str.WriteString(right[i])
+			str.WriteRune(']')
+			continue
+		}
+		str.WriteRune('{')
+		str.WriteString(withQuote(z.keys[0], true))
+		str.WriteString(": ")
+		str.WriteString(left[i])
+		str.WriteString(", ")
+		str.WriteString(withQuote(z.keys[1], true))
+		str.WriteString(": ")
+		str.WriteString(right[i])
+		str.WriteRune('}')
 	}
+	str.WriteRune(']')
 	return str.String(), nil
 }
 
@@ -297,20 +594,74 @@ func (i *literal) Index([]string) (string, error) {
 	return withQuote(i.value, false), nil
 }
 
+// withQuote gives str as a JSON string unless it is already one, or unless it
+// is a JSON literal or a number and all is false. Numbers not written as JSON
+// numbers are quoted by render.
 func withQuote(str string, all bool) string {
+	if len(str) == 0 {
+		return `""`
+	}
 	if str == "true" || str == "false" || str == "null" {
 		return str
 	}
-	if str[0] == '"' && str[len(str)-1] == '"' {
+	if len(str) > 1 && str[0] == '"' && str[len(str)-1] == '"' && json.Valid([]byte(str)) {
 		return str
 	}
 	if !all {
-		_, err := strconv.ParseFloat(str, 64)
-		if err == nil {
+		if _, err := strconv.ParseFloat(str, 64); err == nil {
 			return str
 		}
 	}
-	return fmt.Sprintf("%q", str)
+	return quoteString(str)
+}
+
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// quoteString quotes str as RFC 8259 requires: quotes, backslashes and control
+// characters are escaped, everything else is written as is. Invalid UTF-8
+// sequences are left to the UTF8Policy of the converter.
+func quoteString(str string) string {
+	var buf strings.Builder
+	buf.Grow(len(str) + 2)
+	buf.WriteByte('"')
+	for i := 0; i < len(str); i++ {
+		switch c := str[i]; c {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		default:
+			if c < 0x20 {
+				fmt.Fprintf(&buf, `\u%04x`, c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+func unquote(str string) string {
+	if len(str) < 2 || str[0] != '"' {
+		return str
+	}
+	if s, err := strconv.Unquote(str); err == nil {
+		return s
+	}
+	if str[len(str)-1] == '"' {
+		return str[1 : len(str)-1]
+	}
+	return str
 }
 
 func apply(left, right string, do func(float64, float64) (float64, error)) (string, error) {
@@ -0,0 +1,132 @@
+package comma
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// FromJSON writes the JSON objects (or arrays) read from r as delimited rows in
+// w. fields are the keys (or positions for arrays) projected into each row and
+// missing fields give empty cells. c.Fields, when set, is written as header and
+// gives the keys of objects when fields is empty.
+func (c Converter) FromJSON(r io.Reader, w io.Writer, fields []string) error {
+	var (
+		rs = json.NewDecoder(r)
+		ws = csv.NewWriter(w)
+	)
+	rs.UseNumber()
+	ws.Comma = c.delim
+	if len(c.Fields) > 0 {
+		if err := ws.Write(c.Fields); err != nil {
+			return err
+		}
+	}
+	for {
+		var value interface{}
+		if err := rs.Decode(&value); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+		rows := []interface{}{value}
+		if isRowList(value) {
+			rows = value.([]interface{})
+		}
+		for _, v := range rows {
+			cols := fields
+			if _, ok := v.(map[string]interface{}); ok && len(cols) == 0 {
+				cols = c.Fields
+			}
+			row, err := project(v, cols)
+			if err != nil {
+				return err
+			}
+			if err := ws.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	ws.Flush()
+	return ws.Error()
+}
+
+func isRowList(value interface{}) bool {
+	list, ok := value.([]interface{})
+	if !ok || len(list) == 0 {
+		return false
+	}
+	for i := range list {
+		switch list[i].(type) {
+		case map[string]interface{}, []interface{}:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func project(value interface{}, fields []string) ([]string, error) {
+	var row []string
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%w: fields expected for object rows", ErrSupport)
+		}
+		for _, f := range fields {
+			str, err := cellValue(v[f])
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, str)
+		}
+	case []interface{}:
+		if len(fields) == 0 {
+			for i := range v {
+				str, err := cellValue(v[i])
+				if err != nil {
+					return nil, err
+				}
+				row = append(row, str)
+			}
+			break
+		}
+		for _, f := range fields {
+			n, err := strconv.Atoi(f)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid position for array row", f)
+			}
+			var str string
+			if n >= 0 && n < len(v) {
+				str, err = cellValue(v[n])
+				if err != nil {
+					return nil, err
+				}
+			}
+			row = append(row, str)
+		}
+	default:
+		return nil, fmt.Errorf("%w: object or array expected as row", ErrSupport)
+	}
+	return row, nil
+}
+
+func cellValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+}
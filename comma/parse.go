@@ -18,12 +18,24 @@ type Parser struct {
 	infix  map[rune]func(Indexer) (Indexer, error)
 
 	stack *slices.Stack[rune]
+	env   *environ
 }
 
 func Parse(str string) (Indexer, error) {
+	return parse(str, createEnv())
+}
+
+func parse(str string, env *environ) (Indexer, error) {
+	if strings.TrimSpace(str) == "@object" {
+		r := record{
+			env: env,
+		}
+		return &r, nil
+	}
 	p := Parser{
-		scan:  Scan(strings.TrimSpace(str)),
+		scan:  Scan(str),
 		stack: slices.New[rune](),
+		env:   env,
 	}
 	p.prefix = map[rune]func() (Indexer, error){
 		Sub:     p.parseUnary,
@@ -32,15 +44,24 @@ func Parse(str string) (Indexer, error) {
 		Number:  p.parseUnary,
 		Literal: p.parseUnary,
 		Lparen:  p.parseGroup,
+		Set:     p.parseSet,
 	}
 	p.infix = map[rune]func(Indexer) (Indexer, error){
 		Add:      p.parseBinary,
 		Sub:      p.parseBinary,
 		Mul:      p.parseBinary,
 		Div:      p.parseBinary,
+		FloorDiv: p.parseBinary,
 		Pow:      p.parseBinary,
 		Mod:      p.parseBinary,
 		Question: p.parseTernary,
+		Default:  p.parseDefault,
+		Lt:       p.parseCompare,
+		Le:       p.parseCompare,
+		Gt:       p.parseCompare,
+		Ge:       p.parseCompare,
+		Eq:       p.parseCompare,
+		Ne:       p.parseCompare,
 		Lparen:   p.parseCall,
 	}
 	p.next()
@@ -64,11 +85,11 @@ func (p *Parser) parse() (Indexer, error) {
 		case Comma:
 			p.next()
 			if p.is(Eof) {
-				return nil, fmt.Errorf("parse: unexpected end of input after ','")
+				return nil, p.parseError("unexpected end of input after ','")
 			}
 		case Eof:
 		default:
-			return nil, fmt.Errorf("parse: expected ',' or end of input")
+			return nil, p.parseError("expected ',' or end of input")
 		}
 	}
 	if len(list) == 1 {
@@ -76,6 +97,7 @@ func (p *Parser) parse() (Indexer, error) {
 	}
 	g := group{
 		list: list,
+		env:  p.env,
 	}
 	return &g, nil
 }
@@ -102,39 +124,49 @@ func (p *Parser) parseRange() (Indexer, error) {
 	if err := p.expect(Index, "range: expected '$'"); err != nil {
 		return nil, err
 	}
-	beg, err := strconv.Atoi(p.curr.Literal)
-	if err != nil {
+	rg := interval{
+		flat: p.stack.Top() == Lsquare,
+		env:  p.env,
+	}
+	var err error
+	if rg.beg, rg.from, err = p.parseBound(); err != nil {
 		return nil, err
 	}
-	p.next()
-
-	add := p.is(RangeAdd)
+	rg.add = p.is(RangeAdd)
 
 	p.next()
 	if err := p.expect(Index, "index: expected '$' after '.."); err != nil {
 		return nil, err
 	}
-	end, err := strconv.Atoi(p.curr.Literal)
-	if err != nil {
+	if rg.end, rg.to, err = p.parseBound(); err != nil {
 		return nil, err
 	}
-	rg := interval{
-		beg:  beg,
-		end:  end,
-		add:  add,
-		flat: p.stack.Top() == Lsquare,
-	}
-	p.next()
 	return &rg, nil
 }
 
+// parseBound gives the position or the name of the column at one end of a
+// range.
+func (p *Parser) parseBound() (int, string, error) {
+	defer p.next()
+	if str := p.curr.Literal; str != "" && isLetter(rune(str[0])) {
+		return 0, str, nil
+	}
+	n, err := strconv.Atoi(p.curr.Literal)
+	if err != nil {
+		return 0, "", p.parseError("range: invalid index $%s", p.curr.Literal)
+	}
+	return n, "", nil
+}
+
 func (p *Parser) parseObject() (Indexer, error) {
 	p.stack.Push(Lcurly)
 	defer p.stack.Pop()
 
+	open := p.curr
 	p.next()
 	var obj object
 	obj.fields = make(map[string]Indexer)
+	obj.env = p.env
 	for !p.done() && !p.is(Rcurly) {
 		if err := p.expect(Literal, "object: expected literal"); err != nil {
 			return nil, err
@@ -158,12 +190,14 @@ func (p *Parser) parseObject() (Indexer, error) {
 				return nil, p.parseError("object: expected key after comma, not '}")
 			}
 		case Rcurly:
+		case Eof:
+			return nil, p.parseErrorAt(open, "object: missing closing '}'")
 		default:
 			return nil, p.parseError("object: expected ',' or '}")
 		}
 	}
-	if err := p.expect(Rcurly, "object: expected '}"); err != nil {
-		return nil, err
+	if p.done() {
+		return nil, p.parseErrorAt(open, "object: missing closing '}'")
 	}
 	p.next()
 	return &obj, nil
@@ -173,8 +207,10 @@ func (p *Parser) parseArray() (Indexer, error) {
 	p.stack.Push(Lsquare)
 	defer p.stack.Pop()
 
+	open := p.curr
 	p.next()
 	var arr array
+	arr.env = p.env
 	for !p.done() && !p.is(Rsquare) {
 		ix, err := p.parseSingle()
 		if err != nil {
@@ -188,17 +224,69 @@ func (p *Parser) parseArray() (Indexer, error) {
 				return nil, p.parseError("array: expected key after comma, not ']")
 			}
 		case Rsquare:
+		case Eof:
+			return nil, p.parseErrorAt(open, "array: missing closing ']'")
 		default:
 			return nil, p.parseError("array: expected ',' or ']")
 		}
 	}
-	if err := p.expect(Rsquare, "array: expected ']"); err != nil {
-		return nil, err
+	if p.done() {
+		return nil, p.parseErrorAt(open, "array: missing closing ']'")
 	}
 	p.next()
 	return &arr, nil
 }
 
+func (p *Parser) parseSet() (Indexer, error) {
+	open := p.curr
+	p.next()
+	var s set
+	s.env = p.env
+	for !p.done() && !p.is(Rsquare) {
+		var ix Indexer
+		switch str := p.curr.Literal; {
+		case p.is(Number):
+			n, err := strconv.Atoi(str)
+			if err != nil {
+				return nil, p.parseError("set: invalid column position %s", str)
+			}
+			ix = &index{
+				index: n,
+				env:   p.env,
+			}
+		case p.is(Literal) && str != "" && isLetter(rune(str[0])):
+			ix = &column{
+				name: str,
+				env:  p.env,
+			}
+		default:
+			return nil, p.parseError("set: column position or name expected")
+		}
+		s.index = append(s.index, ix)
+		p.next()
+		switch p.curr.Type {
+		case Comma:
+			p.next()
+			if p.is(Rsquare) {
+				return nil, p.parseError("set: expected column after comma, not ']")
+			}
+		case Rsquare:
+		case Eof:
+			return nil, p.parseErrorAt(open, "set: missing closing ']'")
+		default:
+			return nil, p.parseError("set: expected ',' or ']")
+		}
+	}
+	if p.done() {
+		return nil, p.parseErrorAt(open, "set: missing closing ']'")
+	}
+	if len(s.index) == 0 {
+		return nil, p.parseErrorAt(open, "set: at least one column expected")
+	}
+	p.next()
+	return &s, nil
+}
+
 func (p *Parser) exprDone() bool {
 	return p.done() || p.is(Comma) || p.is(Rcurly) || p.is(Rsquare)
 }
@@ -256,17 +344,50 @@ func (p *Parser) parseTernary(left Indexer) (Indexer, error) {
 	return &test, nil
 }
 
+func (p *Parser) parseDefault(left Indexer) (Indexer, error) {
+	def := defaulted{
+		left: left,
+	}
+	p.next()
+	right, err := p.parseExpression(bindDefault)
+	if err != nil {
+		return nil, err
+	}
+	def.right = right
+	return &def, nil
+}
+
+func (p *Parser) parseCompare(left Indexer) (Indexer, error) {
+	cmp := compare{
+		left: left,
+		op:   p.curr.Type,
+	}
+	p.next()
+	right, err := p.parseExpression(bindCompare)
+	if err != nil {
+		return nil, err
+	}
+	cmp.right = right
+	return &cmp, nil
+}
+
 func (p *Parser) parseCall(left Indexer) (Indexer, error) {
 	i, ok := left.(*literal)
 	if !ok {
 		return nil, p.parseError("invalid call operator")
 	}
+	if i.value == "prev" {
+		return p.parsePrev()
+	}
 	c := call{
 		name: i.value,
 	}
+	p.stack.Push(Lparen)
+	defer p.stack.Pop()
+
 	p.next()
 	for !p.done() && !p.is(Rparen) {
-		ix, err := p.parseExpression(bindLowest)
+		ix, err := p.parseIndexer()
 		if err != nil {
 			return nil, err
 		}
@@ -286,7 +407,79 @@ func (p *Parser) parseCall(left Indexer) (Indexer, error) {
 		return nil, err
 	}
 	p.next()
-	return &c, nil
+	switch c.name {
+	case "cumsum", "cumavg", "cumcount":
+		if len(c.args) != 1 {
+			return nil, p.parseError("%s: expected exactly one argument", c.name)
+		}
+		cum := cumulative{
+			name: c.name,
+			arg:  slices.Fst(c.args),
+		}
+		return &cum, nil
+	case "zip":
+		return p.parseZip(c.args)
+	case "matches", "extract":
+		if len(c.args) < 2 {
+			return &c, nil
+		}
+		if i, ok := c.args[1].(*literal); ok {
+			str, _ := i.Index(nil)
+			re, err := compilePattern(unquote(str))
+			if err != nil {
+				return nil, p.parseError("%s: %s", c.name, err)
+			}
+			c.fn = bindPattern(c.name, re)
+		}
+		return &c, nil
+	default:
+		return &c, nil
+	}
+}
+
+func (p *Parser) parseZip(args []Indexer) (Indexer, error) {
+	if len(args) != 2 && len(args) != 4 {
+		return nil, p.parseError("zip: expected two ranges and optionally two keys")
+	}
+	var (
+		z  zip
+		ok bool
+	)
+	if z.left, ok = args[0].(*interval); !ok || z.left.add {
+		return nil, p.parseError("zip: first argument should be a range")
+	}
+	if z.right, ok = args[1].(*interval); !ok || z.right.add {
+		return nil, p.parseError("zip: second argument should be a range")
+	}
+	for _, a := range args[2:] {
+		k, ok := a.(*literal)
+		if !ok {
+			return nil, p.parseError("zip: keys should be literal")
+		}
+		z.keys = append(z.keys, unquote(k.value))
+	}
+	return &z, nil
+}
+
+func (p *Parser) parsePrev() (Indexer, error) {
+	p.next()
+	if err := p.expect(Index, "prev: expected '$'"); err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(p.curr.Literal)
+	if err != nil {
+		return nil, p.parseError("prev: invalid index $%s", p.curr.Literal)
+	}
+	p.next()
+	if err := p.expect(Rparen, "prev: expected ')' after index"); err != nil {
+		return nil, err
+	}
+	p.next()
+	ix := previous{
+		index: n,
+		env:   p.env,
+	}
+	return &ix, nil
 }
 
 func (p *Parser) parseBinary(left Indexer) (Indexer, error) {
@@ -304,11 +497,15 @@ func (p *Parser) parseBinary(left Indexer) (Indexer, error) {
 }
 
 func (p *Parser) parseGroup() (Indexer, error) {
+	open := p.curr
 	p.next()
 	ix, err := p.parseExpression(bindLowest)
 	if err != nil {
 		return nil, err
 	}
+	if p.done() {
+		return nil, p.parseErrorAt(open, "group: missing closing ')'")
+	}
 	if err := p.expect(Rparen, "group: expected ')'"); err != nil {
 		return nil, err
 	}
@@ -330,12 +527,21 @@ func (p *Parser) parseUnary() (Indexer, error) {
 			right: right,
 		}
 	case Index:
+		if str := p.curr.Literal; str != "" && isLetter(rune(str[0])) {
+			ix = &column{
+				name: str,
+				env:  p.env,
+			}
+			p.next()
+			break
+		}
 		n, err := strconv.Atoi(p.curr.Literal)
 		if err != nil {
-			return nil, err
+			return nil, p.parseError("index: invalid index $%s", p.curr.Literal)
 		}
 		ix = &index{
 			index: n,
+			env:   p.env,
 		}
 		p.next()
 	case Number, Literal:
@@ -374,12 +580,29 @@ func (p *Parser) expect(kind rune, msg string) error {
 }
 
 func (p *Parser) parseError(msg string, args ...interface{}) error {
-	return fmt.Errorf(msg, args...)
+	return p.parseErrorAt(p.curr, msg, args...)
+}
+
+func (p *Parser) parseErrorAt(tok Token, msg string, args ...interface{}) error {
+	return ParseError{
+		Col:     p.scan.column(tok.Offset),
+		Message: fmt.Sprintf(msg, args...),
+	}
+}
+
+type ParseError struct {
+	Col     int
+	Message string
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("parse error at col %d: %s", e.Col, e.Message)
 }
 
 type Token struct {
 	Literal string
 	Type    rune
+	Offset  int
 }
 
 func (t Token) String() string {
@@ -390,6 +613,8 @@ func (t Token) String() string {
 		return "<not>"
 	case Range:
 		return "<range>"
+	case Set:
+		return "<set>"
 	case RangeAdd:
 		return "<range-add>"
 	case Add:
@@ -398,6 +623,8 @@ func (t Token) String() string {
 		return "<subtract>"
 	case Div:
 		return "<divide>"
+	case FloorDiv:
+		return "<floor-divide>"
 	case Mul:
 		return "<multiply>"
 	case Mod:
@@ -418,6 +645,20 @@ func (t Token) String() string {
 		return "<colon>"
 	case Question:
 		return "<question>"
+	case Default:
+		return "<default>"
+	case Lt:
+		return "<lt>"
+	case Le:
+		return "<le>"
+	case Gt:
+		return "<gt>"
+	case Ge:
+		return "<ge>"
+	case Eq:
+		return "<eq>"
+	case Ne:
+		return "<ne>"
 	case Invalid:
 		if t.Literal != "" {
 			return fmt.Sprintf("invalid(%s)", t.Literal)
@@ -457,23 +698,44 @@ const (
 	Mod
 	Not
 	Question
+	Default
+	Lt
+	Le
+	Gt
+	Ge
+	Eq
+	Ne
+	Set
+	FloorDiv
 	Invalid
 )
 
 type bindmap map[rune]int
 
 var bindings = bindmap{
-	Add:    bindAdd,
-	Sub:    bindAdd,
-	Mul:    bindMul,
-	Div:    bindMul,
-	Pow:    bindMul,
-	Mod:    bindMul,
-	Lparen: bindCall,
+	Question: bindTernary,
+	Default:  bindDefault,
+	Lt:       bindCompare,
+	Le:       bindCompare,
+	Gt:       bindCompare,
+	Ge:       bindCompare,
+	Eq:       bindCompare,
+	Ne:       bindCompare,
+	Add:      bindAdd,
+	Sub:      bindAdd,
+	Mul:      bindMul,
+	Div:      bindMul,
+	FloorDiv: bindMul,
+	Pow:      bindMul,
+	Mod:      bindMul,
+	Lparen:   bindCall,
 }
 
 const (
 	bindLowest = iota
+	bindTernary
+	bindDefault
+	bindCompare
 	bindAdd
 	bindMul
 	bindPrefix
@@ -504,8 +766,10 @@ func Scan(str string) *Scanner {
 func (s *Scanner) Scan() Token {
 	var tok Token
 	s.read()
+	tok.Offset = s.curr
 	if s.done() {
 		tok.Type = Eof
+		tok.Offset = len(s.input)
 		return tok
 	}
 	switch {
@@ -531,11 +795,28 @@ func (s *Scanner) Scan() Token {
 }
 
 func (s *Scanner) scanIndex(tok *Token) {
+	if s.peek() == '[' {
+		s.read()
+		tok.Type = Set
+		tok.Literal = "$["
+		return
+	}
+	defer s.unread()
+
 	s.read()
-	s.scanNumber(tok)
-	if tok.Type == Number {
-		tok.Type = Index
+	pos := s.curr
+	if isLetter(s.char) {
+		for !s.done() && isAlpha(s.char) {
+			s.read()
+		}
+	} else {
+		if s.char == '-' && isDigit(s.peek()) {
+			s.read()
+		}
+		s.scanDigits()
 	}
+	tok.Type = Index
+	tok.Literal = string(s.input[pos:s.curr])
 }
 
 func (s *Scanner) scanIdent(tok *Token) {
@@ -569,13 +850,36 @@ func (s *Scanner) scanNumber(tok *Token) {
 	defer s.unread()
 
 	pos := s.curr
-	for !s.done() && isDigit(s.char) {
+	s.scanDigits()
+	if s.char == '.' && isDigit(s.peek()) {
 		s.read()
+		s.scanDigits()
+	}
+	if (s.char == 'e' || s.char == 'E') && s.isExponent() {
+		s.read()
+		if s.char == '+' || s.char == '-' {
+			s.read()
+		}
+		s.scanDigits()
 	}
 	tok.Type = Number
 	tok.Literal = string(s.input[pos:s.curr])
 }
 
+func (s *Scanner) isExponent() bool {
+	next := s.next
+	if next < len(s.input) && (s.input[next] == '+' || s.input[next] == '-') {
+		next++
+	}
+	return next < len(s.input) && isDigit(rune(s.input[next]))
+}
+
+func (s *Scanner) scanDigits() {
+	for !s.done() && isDigit(s.char) {
+		s.read()
+	}
+}
+
 func (s *Scanner) scanOperator(tok *Token) {
 	switch s.char {
 	case '+':
@@ -595,12 +899,42 @@ func (s *Scanner) scanOperator(tok *Token) {
 		}
 	case '/':
 		tok.Type = Div
+		if k := s.peek(); k == s.char {
+			tok.Type = FloorDiv
+			s.read()
+		}
 	case '%':
 		tok.Type = Mod
 	case '!':
 		tok.Type = Not
+		if k := s.peek(); k == '=' {
+			tok.Type = Ne
+			s.read()
+		}
+	case '<':
+		tok.Type = Lt
+		if k := s.peek(); k == '=' {
+			tok.Type = Le
+			s.read()
+		}
+	case '>':
+		tok.Type = Gt
+		if k := s.peek(); k == '=' {
+			tok.Type = Ge
+			s.read()
+		}
+	case '=':
+		tok.Type = Invalid
+		if k := s.peek(); k == s.char {
+			tok.Type = Eq
+			s.read()
+		}
 	case '?':
 		tok.Type = Question
+		if k := s.peek(); k == s.char {
+			tok.Type = Default
+			s.read()
+		}
 	default:
 		tok.Type = Invalid
 	}
@@ -680,6 +1014,14 @@ func (s *Scanner) check(vs ...rune) bool {
 	return true
 }
 
+// column gives the position, counted in runes from one, of the byte at offset.
+func (s *Scanner) column(offset int) int {
+	if offset > len(s.input) {
+		offset = len(s.input)
+	}
+	return utf8.RuneCount(s.input[:offset]) + 1
+}
+
 func (s *Scanner) done() bool {
 	return s.curr >= len(s.input)
 }
@@ -717,7 +1059,7 @@ func isIndex(r rune) bool {
 }
 
 func isOperator(r rune) bool {
-	return r == '+' || r == '-' || r == '*' || r == '%' || r == '/' || r == '!' || r == '?'
+	return r == '+' || r == '-' || r == '*' || r == '%' || r == '/' || r == '!' || r == '?' || r == '<' || r == '>' || r == '='
 }
 
 func isDelim(r rune) bool {
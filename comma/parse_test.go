@@ -0,0 +1,298 @@
+package comma
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	row := []string{"1", "0", "3", "4"}
+	data := []struct {
+		Query string
+		Want  string
+	}{
+		{
+			Query: `$0 ? "y" : "n"`,
+			Want:  `"y"`,
+		},
+		{
+			Query: `{flag: $1 ? "y" : "n", total: $2 + $3}`,
+			Want:  `{"flag": "n", "total": 7}`,
+		},
+		{
+			Query: `[$0 ? $2 * 2 : 0, $2 * $3, "x"]`,
+			Want:  `[6, 12, "x"]`,
+		},
+		{
+			Query: `{a: $1 ? "y" : $0 ? "z" : "n"}`,
+			Want:  `{"a": "z"}`,
+		},
+		{
+			Query: `$2 > $0 ? "gt" : "le"`,
+			Want:  `"gt"`,
+		},
+		{
+			Query: `$3 <= 4, $0 == 1, $1 != 0, $2 + 1 >= $3`,
+			Want:  `true, true, false, true`,
+		},
+		{
+			Query: `"abc" < "abd" ? "lt" : "ge", "10" > "9"`,
+			Want:  `"lt", false`,
+		},
+		{
+			Query: `$1 == 0 ? $3 : $2`,
+			Want:  `4`,
+		},
+		{
+			Query: `$2 > 3.14 ? "gt" : "le", $2 > 2.5, -3.5 + $0`,
+			Want:  `"le", true, -2.5`,
+		},
+		{
+			Query: `[1.5e2, 2E-1 * $3, $1..$2]`,
+			Want:  `[1.5e2, 0.8, 0, 3]`,
+		},
+		{
+			Query: `typeof($0) == "number" ? $0 : 0, typeof("foo"), typeof($1 > 0)`,
+			Want:  `1, "string", "bool"`,
+		},
+		{
+			Query: `{ratio: pct($2, $3, 1)}`,
+			Want:  `{"ratio": "75.0%"}`,
+		},
+		{
+			Query: `join($0, $2, "x", "-")`,
+			Want:  `"1-3-x"`,
+		},
+		{
+			Query: `{parts: split("a;b", ";"), sub: substr("foobar", 3, 3)}`,
+			Want:  `{"parts": ["a", "b"], "sub": "bar"}`,
+		},
+		{
+			Query: `extract("id-42", "(\\d+)", "1"), matches("id-42", "^id-")`,
+			Want:  `42, true`,
+		},
+		{
+			Query: `7 / 2, 7 // 2, 6 / 3, -7 // 2, $3 // $2 * 2`,
+			Want:  `3.5, 3, 2, -4, 2`,
+		},
+		{
+			Query: `$[0, 2, 3], {picked: $[3,1]}`,
+			Want:  `[1, 3, 4], {"picked": [4, 0]}`,
+		},
+	}
+	for _, d := range data {
+		q, err := Parse(d.Query)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		got, err := q.Index(row)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%s: result mismatched! want %s, got %s", d.Query, d.Want, got)
+		}
+	}
+}
+
+func TestParseNegativeIndex(t *testing.T) {
+	q, err := Parse(`$-1, $-2, $0-$-1`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	data := []struct {
+		Row  []string
+		Want string
+	}{
+		{
+			Row:  []string{"1", "2"},
+			Want: `2, 1, -1`,
+		},
+		{
+			Row:  []string{"10", "20", "30", "40"},
+			Want: `40, 30, -30`,
+		},
+	}
+	for _, d := range data {
+		got, err := q.Index(d.Row)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %s", d.Row, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%v: result mismatched! want %s, got %s", d.Row, d.Want, got)
+		}
+	}
+	if _, err := q.Index([]string{"1"}); !errors.Is(err, ErrIndex) {
+		t.Errorf("expected ErrIndex for short row, got %v", err)
+	}
+}
+
+func TestParseFloorDivZero(t *testing.T) {
+	q, err := Parse(`$0 // $1`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := q.Index([]string{"1", "0"}); !errors.Is(err, ErrZero) {
+		t.Errorf("expected ErrZero, got %v", err)
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	q, err := Parse(`matches($0, "^[a-z]+$")`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if c, ok := q.(*call); !ok || c.fn == nil {
+		t.Errorf("literal pattern not compiled by the parser")
+	}
+	var perr ParseError
+	if _, err := Parse(`extract($0, "(foo", 1)`); !errors.As(err, &perr) {
+		t.Errorf("expected ParseError for invalid pattern, got %v", err)
+	}
+
+	q, err = Parse(`matches($0, $1)`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rows := []struct {
+		Row  []string
+		Want string
+	}{
+		{Row: []string{"foo", "^f"}, Want: "true"},
+		{Row: []string{"bar", "^f"}, Want: "false"},
+		{Row: []string{"bar", "r$"}, Want: "true"},
+	}
+	for _, d := range rows {
+		got, err := q.Index(d.Row)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %s", d.Row, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%v: result mismatched! want %s, got %s", d.Row, d.Want, got)
+		}
+	}
+	if _, err := q.Index([]string{"foo", "(foo"}); !errors.Is(err, ErrValue) {
+		t.Errorf("expected value error for invalid pattern, got %v", err)
+	}
+}
+
+func TestParseZip(t *testing.T) {
+	row := []string{"a", "b", "c", "1", "2", "3", "x"}
+	data := []struct {
+		Query string
+		Want  string
+	}{
+		{
+			Query: `zip($0..$2, $3..$5, "k", "v")`,
+			Want:  `[{"k": "a", "v": 1}, {"k": "b", "v": 2}, {"k": "c", "v": 3}]`,
+		},
+		{
+			Query: `zip($0..$2, $3..$5)`,
+			Want:  `[["a", 1], ["b", 2], ["c", 3]]`,
+		},
+		{
+			Query: `zip($0..$1, $3..$6)`,
+			Want:  `[["a", 1], ["b", 2]]`,
+		},
+	}
+	for _, d := range data {
+		q, err := Parse(d.Query)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		got, err := q.Index(row)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%s: result mismatched! want %s, got %s", d.Query, d.Want, got)
+		}
+	}
+	for _, str := range []string{`zip($0..$2)`, `zip($0, $1)`, `zip($0..$1, $2..$3, "k")`} {
+		if _, err := Parse(str); err == nil {
+			t.Errorf("%s: invalid zip parsed successfully", str)
+		}
+	}
+}
+
+func TestParse_Error(t *testing.T) {
+	data := []struct {
+		Input string
+		Col   int
+	}{
+		{
+			Input: `$0, [$1`,
+			Col:   5,
+		},
+		{
+			Input: `{name: $0, age: $1`,
+			Col:   1,
+		},
+		{
+			Input: `$0, {name: [$1, $2}`,
+			Col:   19,
+		},
+		{
+			Input: `$0, ($1 + $2`,
+			Col:   5,
+		},
+		{
+			Input: `$0 $1`,
+			Col:   4,
+		},
+		{
+			Input: `$0..$`,
+			Col:   5,
+		},
+		{
+			Input: `$0, $[1, $2]`,
+			Col:   10,
+		},
+		{
+			Input: `$[1, 2`,
+			Col:   1,
+		},
+		{
+			Input: `  $0, [$1`,
+			Col:   7,
+		},
+		{
+			Input: "\t$0 $1  ",
+			Col:   5,
+		},
+		{
+			Input: `"é", [$1`,
+			Col:   6,
+		},
+		{
+			Input: `{"clé": $0 $1}`,
+			Col:   12,
+		},
+	}
+	for _, d := range data {
+		_, err := Parse(d.Input)
+		if err == nil {
+			t.Errorf("%s: invalid query parsed successfully", d.Input)
+			continue
+		}
+		var perr ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s: expected ParseError, got %T (%s)", d.Input, err, err)
+			continue
+		}
+		if perr.Col != d.Col {
+			t.Errorf("%s: position mismatched! want %d, got %d (%s)", d.Input, d.Col, perr.Col, err)
+		}
+	}
+	_, err := Parse(`$0 $1`)
+	want := "parse error at col 4: expected ',' or end of input"
+	if err == nil || err.Error() != want {
+		t.Errorf("error message mismatched! want %q, got %v", want, err)
+	}
+}
@@ -34,13 +34,41 @@ func debug(w io.Writer, q Query, level int, nonl bool) {
 		fmt.Fprintf(w, "%sliteral(%s)", header, q.value)
 		fmt.Fprintln(w)
 	case *ptr:
-		fmt.Fprintf(w, "%sptr", header)
+		fmt.Fprintf(w, "%sptr [", header)
+		fmt.Fprintln(w)
+		debug(w, q.Query, level+1, false)
+		fmt.Fprintf(w, "%s]", prefix)
 		fmt.Fprintln(w)
 	case *recurse:
 		fmt.Fprintf(w, "%srecurse [", header)
+		fmt.Fprintln(w)
 		debug(w, q.Query, level+1, false)
 		fmt.Fprintf(w, "%s]", prefix)
 		fmt.Fprintln(w)
+	case *transform:
+		if q.format {
+			fmt.Fprintf(w, "%sformat(@%s)", header, q.name)
+		} else {
+			fmt.Fprintf(w, "%s%s", header, q.name)
+		}
+		fmt.Fprintln(w)
+	case *add:
+		fmt.Fprintf(w, "%sadd", header)
+		fmt.Fprintln(w)
+	case *edge:
+		fmt.Fprintf(w, "%s%s", header, q.name())
+		fmt.Fprintln(w)
+	case *reduce:
+		fmt.Fprintf(w, "%s%s", header, q.name)
+		if q.by != nil {
+			fmt.Fprintln(w, " [")
+			debug(w, q.by, level+1, false)
+			fmt.Fprintf(w, "%s]", prefix)
+		}
+		fmt.Fprintln(w)
+	case *regex:
+		fmt.Fprintf(w, "%s%s(%s)", header, q.name, strings.Join(q.args, ", "))
+		fmt.Fprintln(w)
 	case *all:
 		fmt.Fprintf(w, "%sall", header)
 		fmt.Fprintln(w)
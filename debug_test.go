@@ -0,0 +1,36 @@
+package query
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDebug(t *testing.T) {
+	data := []struct {
+		Query string
+		Want  string
+	}{
+		{
+			Query: `..foo | $`,
+			Want:  "pipeline [\n  recurse [\n    ident(foo)\n  ]\n  ptr [\n    ident(foo)\n  ]\n]\n",
+		},
+		{
+			Query: `.foo | .bar | $1`,
+			Want:  "pipeline [\n  ident(foo)\n  ident(bar)\n  ptr [\n    ident(bar)\n  ]\n]\n",
+		},
+		{
+			Query: `[.foo, 42]`,
+			Want:  "array [\n  ident(foo)\n  literal(42)\n]\n",
+		},
+	}
+	for _, d := range data {
+		var str strings.Builder
+		if err := Debug(&str, d.Query); err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if got := str.String(); got != d.Want {
+			t.Errorf("%s: result mismatched! want %q, got %q", d.Query, d.Want, got)
+		}
+	}
+}
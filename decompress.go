@@ -0,0 +1,48 @@
+package query
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func AutoDecompress(r io.Reader) (io.Reader, error) {
+	magic := make([]byte, len(gzipMagic))
+	n, err := io.ReadFull(r, magic)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	var (
+		rs   = io.MultiReader(bytes.NewReader(magic[:n]), r)
+		name string
+	)
+	if f, ok := r.(interface{ Name() string }); ok {
+		name = f.Name()
+	}
+	if bytes.Equal(magic[:n], gzipMagic) {
+		z, err := gzip.NewReader(rs)
+		if err != nil {
+			return nil, err
+		}
+		rs = z
+	}
+	if name == "" {
+		return rs, nil
+	}
+	return namedReader{
+		Reader: rs,
+		name:   name,
+	}, nil
+}
+
+type namedReader struct {
+	io.Reader
+	name string
+}
+
+func (r namedReader) Name() string {
+	return r.name
+}
@@ -0,0 +1,221 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type collector interface {
+	collect(string, interface{})
+	get() interface{}
+}
+
+type objCollector struct {
+	values map[string]interface{}
+}
+
+func collectObject() collector {
+	return &objCollector{
+		values: make(map[string]interface{}),
+	}
+}
+
+func (c *objCollector) collect(key string, value interface{}) {
+	c.values[key] = value
+}
+
+func (c *objCollector) get() interface{} {
+	return c.values
+}
+
+type arrCollector struct {
+	values []interface{}
+}
+
+func collectArray() collector {
+	return &arrCollector{
+		values: []interface{}{},
+	}
+}
+
+func (c *arrCollector) collect(_ string, value interface{}) {
+	c.values = append(c.values, value)
+}
+
+func (c *arrCollector) get() interface{} {
+	return c.values
+}
+
+func (r *reader) Decode() (interface{}, error) {
+	v, err := r.decode()
+	if err != nil {
+		return nil, err
+	}
+	if err = r.end(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// decodeOne applies q to the next document and gives the values selected as Go
+// values with their number. The values selected by the whole document or by a
+// path of keys and indexes are built while the document is read. Other queries
+// keep their results as text, so they are decoded once the document is read.
+func (r *reader) decodeOne(q Query) (interface{}, int, error) {
+	if _, ok := q.(*all); ok {
+		v, err := r.decode()
+		return v, 1, err
+	}
+	if !isSimplePath(q) {
+		if err := r.readOne(q); err != nil {
+			return nil, 0, err
+		}
+		str := q.String()
+		if str == "" || len(q.Get()) == 0 {
+			return nil, 0, nil
+		}
+		rs := prepare(strings.NewReader(str))
+		rs.cfg = r.cfg
+		v, err := rs.Decode()
+		return v, len(q.Get()), err
+	}
+	var values []interface{}
+	r.collect = func(v interface{}) {
+		values = append(values, v)
+	}
+	defer func() {
+		r.collect = nil
+	}()
+	if err := r.readOne(q); err != nil {
+		return nil, 0, err
+	}
+	switch len(values) {
+	case 0:
+		return nil, 0, nil
+	case 1:
+		return values[0], 1, nil
+	default:
+		return values, len(values), nil
+	}
+}
+
+func (r *reader) decode() (interface{}, error) {
+	if !r.unescape {
+		r.unescape = true
+		defer func() {
+			r.unescape = false
+		}()
+	}
+	c, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case jsonQuote(c):
+		return r.literal()
+	case jsonIdent(c):
+		return r.identifier()
+	case jsonNumber(c):
+		str, err := r.number()
+		if err != nil {
+			return nil, err
+		}
+		if r.cfg.UseNumber {
+			return json.Number(str), nil
+		}
+		return getNumber(str)
+	case jsonArray(c):
+		return r.decodeArray(collectArray())
+	case jsonObject(c):
+		return r.decodeObject(collectObject())
+	default:
+		return nil, r.malformed("unexpected character %c", c)
+	}
+}
+
+func (r *reader) decodeObject(col collector) (interface{}, error) {
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
+
+	if c, _ := r.read(); c == '}' {
+		return col.get(), nil
+	}
+	r.unread()
+	seen := r.keys()
+	for {
+		key, err := r.key()
+		if err != nil {
+			return nil, err
+		}
+		if err := r.unique(seen, key); err != nil {
+			return nil, err
+		}
+		value, err := r.decode()
+		if err != nil {
+			return nil, err
+		}
+		col.collect(key, value)
+		if err := r.endObject(); err != nil {
+			if isDone(err) {
+				break
+			}
+			return nil, err
+		}
+	}
+	return col.get(), nil
+}
+
+func (r *reader) decodeArray(col collector) (interface{}, error) {
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
+
+	if c, _ := r.read(); c == ']' {
+		return col.get(), nil
+	}
+	r.unread()
+	for i := 0; ; i++ {
+		value, err := r.decode()
+		if err != nil {
+			return nil, err
+		}
+		col.collect(strconv.Itoa(i), value)
+		if err := r.endArray(); err != nil {
+			if isDone(err) {
+				break
+			}
+			return nil, err
+		}
+	}
+	return col.get(), nil
+}
+
+func getNumber(str string) (interface{}, error) {
+	if strings.IndexAny(str, ".eE") < 0 {
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err == nil {
+			return n, nil
+		}
+	}
+	return getFloat(str)
+}
+
+func getFloat(str string) (interface{}, error) {
+	return strconv.ParseFloat(str, 64)
+}
+
+func getBool(str string) (bool, error) {
+	switch str {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s: not a boolean", str)
+	}
+}
@@ -0,0 +1,440 @@
+package query
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Engine parses and executes queries with a set of options. Its zero value
+// executes queries with the default behaviour.
+type Engine struct {
+	// Newline appends a newline to the result unless it already ends with one
+	Newline bool
+	// Lenient accepts numbers starting with a '+' sign. The sign is dropped from
+	// the output.
+	Lenient bool
+	// KeepNulls writes the fields of a constructed object as null when their
+	// query selects nothing in the document instead of omitting them.
+	KeepNulls bool
+	// UseNumber makes Decode give numbers as json.Number instead of int64 or
+	// float64 so that their original text, and so their precision, is kept.
+	UseNumber bool
+	// MultiDocument reads the input as a sequence of JSON documents, separated
+	// by blanks or not separated at all. The query is applied to each document
+	// and the results are written one per line.
+	MultiDocument bool
+	// RejectDuplicates makes objects with the same key more than once
+	// malformed.
+	RejectDuplicates bool
+	// MaxDepth limits the nesting of arrays and objects in the document. Zero
+	// uses DefaultMaxDepth and a negative value removes the limit.
+	MaxDepth int
+	// Strict rejects strings with unescaped control characters or invalid UTF-8
+	// sequences as RFC 8259 requires. By default, they are passed through.
+	Strict bool
+	// BufferSize is the size of the buffer used to read the document. Zero
+	// uses DefaultBufferSize.
+	BufferSize int
+	// Relaxed accepts line (//) and block (/* */) comments and trailing commas
+	// in arrays and objects, as found in JSONC documents.
+	Relaxed bool
+	// StrictTypes fails when a key is looked for in an array or a scalar, or
+	// an index in an object or a scalar, instead of selecting nothing.
+	StrictTypes bool
+	// Indent writes the result with each element of arrays and objects on its
+	// own line, indented with Indent for each level of nesting.
+	Indent string
+	// Compact writes the result without any blank between its elements. It
+	// has no effect when Indent is set.
+	Compact bool
+	// Raw writes a result that is a single string without its quotes and with
+	// its escape sequences decoded.
+	Raw bool
+}
+
+const (
+	DefaultMaxDepth   = 10000
+	DefaultBufferSize = 4096
+)
+
+type Option func(*Engine)
+
+func NewEngine(opts ...Option) *Engine {
+	var e Engine
+	for _, o := range opts {
+		o(&e)
+	}
+	return &e
+}
+
+// TrailingNewline sets Engine.Newline.
+func TrailingNewline(on bool) Option {
+	return func(e *Engine) {
+		e.Newline = on
+	}
+}
+
+// LenientNumbers sets Engine.Lenient.
+func LenientNumbers(on bool) Option {
+	return func(e *Engine) {
+		e.Lenient = on
+	}
+}
+
+// KeepNulls sets Engine.KeepNulls.
+func KeepNulls(on bool) Option {
+	return func(e *Engine) {
+		e.KeepNulls = on
+	}
+}
+
+// UseNumber sets Engine.UseNumber.
+func UseNumber(on bool) Option {
+	return func(e *Engine) {
+		e.UseNumber = on
+	}
+}
+
+// MultiDocument sets Engine.MultiDocument.
+func MultiDocument(on bool) Option {
+	return func(e *Engine) {
+		e.MultiDocument = on
+	}
+}
+
+// MaxDepth sets Engine.MaxDepth.
+func MaxDepth(depth int) Option {
+	return func(e *Engine) {
+		e.MaxDepth = depth
+	}
+}
+
+// RejectDuplicateKeys sets Engine.RejectDuplicates.
+func RejectDuplicateKeys(on bool) Option {
+	return func(e *Engine) {
+		e.RejectDuplicates = on
+	}
+}
+
+// StrictStrings sets Engine.Strict.
+func StrictStrings(on bool) Option {
+	return func(e *Engine) {
+		e.Strict = on
+	}
+}
+
+// BufferSize sets Engine.BufferSize.
+func BufferSize(size int) Option {
+	return func(e *Engine) {
+		e.BufferSize = size
+	}
+}
+
+// RelaxedSyntax sets Engine.Relaxed.
+func RelaxedSyntax(on bool) Option {
+	return func(e *Engine) {
+		e.Relaxed = on
+	}
+}
+
+// StrictTypes sets Engine.StrictTypes.
+func StrictTypes(on bool) Option {
+	return func(e *Engine) {
+		e.StrictTypes = on
+	}
+}
+
+// Indent sets Engine.Indent.
+func Indent(indent string) Option {
+	return func(e *Engine) {
+		e.Indent = indent
+	}
+}
+
+// Compact sets Engine.Compact.
+func Compact(on bool) Option {
+	return func(e *Engine) {
+		e.Compact = on
+	}
+}
+
+// RawStrings sets Engine.Raw.
+func RawStrings(on bool) Option {
+	return func(e *Engine) {
+		e.Raw = on
+	}
+}
+
+// Compile parses query and prepares it to be executed by the engine.
+func (e *Engine) Compile(query string) (Query, error) {
+	q, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	e.apply(q)
+	return q, nil
+}
+
+func (e *Engine) Run(r io.Reader, query string) (string, error) {
+	return e.RunContext(context.Background(), r, query)
+}
+
+func (e *Engine) RunContext(ctx context.Context, r io.Reader, query string) (string, error) {
+	q, err := e.Compile(query)
+	if err != nil {
+		return "", err
+	}
+	return e.execute(ctx, r, q)
+}
+
+// RunQuery executes a query built without the parser, eg by a Builder. The
+// query itself is left untouched so that it can be run again.
+func (e *Engine) RunQuery(r io.Reader, q Query) (string, error) {
+	return e.RunQueryContext(context.Background(), r, q)
+}
+
+func (e *Engine) RunQueryContext(ctx context.Context, r io.Reader, q Query) (string, error) {
+	q = q.Clone()
+	e.apply(q)
+	return e.execute(ctx, r, q)
+}
+
+func (e *Engine) execute(ctx context.Context, r io.Reader, q Query) (string, error) {
+	rs := e.prepare(r)
+	rs.ctx = ctx
+	env := environ{
+		cfg: *e,
+		ctx: ctx,
+	}
+	bind(q, &env)
+	if e.MultiDocument {
+		return rs.readAll(q)
+	}
+	if err := rs.Read(q); err != nil {
+		return "", err
+	}
+	str, err := e.output(q.String())
+	if err != nil {
+		return "", err
+	}
+	return e.finish(str), nil
+}
+
+func (e *Engine) Each(r io.Reader, query string, fn func(interface{}) error) error {
+	return e.stream(r, query, func(str string) error {
+		rs := prepare(strings.NewReader(str))
+		rs.cfg = *e
+		v, err := rs.Decode()
+		if err != nil {
+			return err
+		}
+		return fn(v)
+	})
+}
+
+// Stream writes each value selected by query in the document read from r to w,
+// one per line.
+func (e *Engine) Stream(w io.Writer, r io.Reader, query string) error {
+	ws := bufio.NewWriter(w)
+	err := e.stream(r, query, func(str string) error {
+		str, err := e.output(str)
+		if err != nil {
+			return err
+		}
+		if _, err := ws.WriteString(str); err != nil {
+			return err
+		}
+		return ws.WriteByte('\n')
+	})
+	if err != nil {
+		return err
+	}
+	return ws.Flush()
+}
+
+func (e *Engine) stream(r io.Reader, query string, fn func(string) error) error {
+	q, err := e.Compile(query)
+	if err != nil {
+		return err
+	}
+	emit := func(q Query) error {
+		for _, str := range q.Get() {
+			if err := fn(str); err != nil {
+				return err
+			}
+		}
+		q.clear()
+		return nil
+	}
+	rs := e.prepare(r)
+	env := environ{
+		cfg: *e,
+		ctx: rs.ctx,
+	}
+	bind(q, &env)
+	if isPath(q) {
+		rs.emit = emit
+	}
+	for {
+		curr := q
+		if e.MultiDocument {
+			curr = q.Clone()
+		}
+		if err := rs.readOne(curr); err != nil {
+			return err
+		}
+		if rs.emit == nil {
+			if err := emit(curr); err != nil {
+				return err
+			}
+		}
+		if !e.MultiDocument {
+			return rs.end()
+		}
+		ok, err := rs.more()
+		if err != nil || !ok {
+			return err
+		}
+	}
+}
+
+// Decode gives the values selected by query as Go values, or nil when query
+// selects nothing. With MultiDocument, the values of each document are given
+// in a []interface{}, the documents where query selects nothing being skipped
+// like in Run.
+func (e *Engine) Decode(r io.Reader, query string) (interface{}, error) {
+	q, err := e.Compile(query)
+	if err != nil {
+		return nil, err
+	}
+	rs := e.prepare(r)
+	env := environ{
+		cfg: *e,
+		ctx: rs.ctx,
+	}
+	bind(q, &env)
+	if !e.MultiDocument {
+		v, _, err := rs.decodeOne(q)
+		if err != nil {
+			return nil, err
+		}
+		return v, rs.end()
+	}
+	var list []interface{}
+	for {
+		v, n, err := rs.decodeOne(q.Clone())
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			list = append(list, v)
+		}
+		ok, err := rs.more()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+	}
+	return list, nil
+}
+
+// Validate reads the whole input from r without applying any query and gives
+// the first error found in it. With MultiDocument, every document is checked.
+func (e *Engine) Validate(r io.Reader) error {
+	rs := e.prepare(r)
+	for {
+		err := rs.readOne(nil)
+		if errors.Is(err, io.EOF) {
+			err = rs.malformed("unexpected end of document")
+		}
+		if err != nil {
+			return err
+		}
+		if !e.MultiDocument {
+			return rs.end()
+		}
+		ok, err := rs.more()
+		if err != nil || !ok {
+			return err
+		}
+	}
+}
+
+func (e *Engine) prepare(r io.Reader) *reader {
+	size := e.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	if e.Relaxed {
+		r = relax(r)
+	}
+	rs := prepareSize(r, size)
+	rs.cfg = *e
+	return rs
+}
+
+func (e *Engine) apply(q Query) {
+	if !e.KeepNulls {
+		return
+	}
+	Walk(q, func(q Query) bool {
+		if o, ok := q.(*object); ok {
+			o.nulls = true
+		}
+		return true
+	})
+}
+
+func (e *Engine) maxDepth() int {
+	if e.MaxDepth == 0 {
+		return DefaultMaxDepth
+	}
+	return e.MaxDepth
+}
+
+// output writes the result of a query as asked by Raw, Indent and Compact.
+func (e *Engine) output(str string) (string, error) {
+	if str == "" {
+		return str, nil
+	}
+	if e.Raw && str[0] == '"' {
+		rs := prepare(strings.NewReader(str))
+		v, err := rs.Decode()
+		if err != nil {
+			return "", err
+		}
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	}
+	if e.Indent == "" && !e.Compact {
+		return str, nil
+	}
+	var (
+		buf strings.Builder
+		p   = printer{
+			Writer:  bufio.NewWriter(&buf),
+			indent:  e.Indent,
+			compact: e.Indent == "",
+		}
+	)
+	if err := p.print(strings.NewReader(str)); err != nil {
+		return "", err
+	}
+	if err := p.Flush(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (e *Engine) finish(str string) string {
+	if e.Newline && !strings.HasSuffix(str, "\n") {
+		str += "\n"
+	}
+	return str
+}
@@ -14,6 +14,15 @@ func (e MalformedError) Error() string {
 	return fmt.Sprintf("%s %s: %s", e.Position, e.File, e.Message)
 }
 
+type ParseError struct {
+	Position
+	Message string
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Position, e.Message)
+}
+
 func invalidQueryForType(kind string) error {
 	return fmt.Errorf("given query can not be used with JSON %s", kind)
 }
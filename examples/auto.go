@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/midbel/query"
+	"github.com/midbel/query/comma"
+)
+
+func main() {
+	flag.Parse()
+
+	var r io.Reader = os.Stdin
+	if f, err := os.Open(flag.Arg(1)); err == nil {
+		defer f.Close()
+		r = f
+	} else {
+		if flag.Arg(1) != "" {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	r, err := query.AutoDecompress(r)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	r, isJSON, err := query.SniffJSON(r)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if isJSON {
+		res, err := query.Execute(r, flag.Arg(0), query.TrailingNewline(true))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Print(res)
+		return
+	}
+	if err := comma.Csv().Convert(r, os.Stdout, flag.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stdout)
+}
@@ -23,10 +23,10 @@ func main() {
 		}
 	}
 
-	res, err := query.Execute(r, flag.Arg(0))
+	res, err := query.Execute(r, flag.Arg(0), query.TrailingNewline(true))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	fmt.Println(res)
+	fmt.Print(res)
 }
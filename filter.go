@@ -3,10 +3,14 @@ package query
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 type Position struct {
@@ -29,15 +33,50 @@ func Filter(r io.Reader, query string) ([]string, error) {
 	return q.Get(), nil
 }
 
-func Execute(r io.Reader, query string) (string, error) {
-	q, err := Parse(query)
-	if err != nil {
-		return "", err
-	}
-	if err := execute(r, q); err != nil {
-		return "", err
-	}
-	return q.String(), nil
+func Execute(r io.Reader, query string, opts ...Option) (string, error) {
+	return ExecuteContext(context.Background(), r, query, opts...)
+}
+
+func ExecuteContext(ctx context.Context, r io.Reader, query string, opts ...Option) (string, error) {
+	return NewEngine(opts...).RunContext(ctx, r, query)
+}
+
+// ExecuteLine is like Execute but the result always ends with exactly one
+// newline.
+func ExecuteLine(r io.Reader, query string, opts ...Option) (string, error) {
+	opts = append(opts, TrailingNewline(true))
+	return Execute(r, query, opts...)
+}
+
+// ExecuteQuery is like Execute but with a query built without the parser, eg by
+// a Builder.
+func ExecuteQuery(r io.Reader, q Query, opts ...Option) (string, error) {
+	return NewEngine(opts...).RunQuery(r, q)
+}
+
+func Validate(r io.Reader, opts ...Option) error {
+	return NewEngine(opts...).Validate(r)
+}
+
+// Each calls fn with each value selected by query in the document read from r
+// and stops at the first error returned by fn. Values selected by a path (keys,
+// indexes and pipelines after them) are given as soon as they are read and are
+// not kept, so, unlike Decode, the memory used does not depend on the number of
+// values selected. Values built by other queries (objects, arrays...) are only
+// available once the whole document has been read.
+func Each(r io.Reader, query string, fn func(interface{}) error, opts ...Option) error {
+	return NewEngine(opts...).Each(r, query, fn)
+}
+
+// Stream writes each value selected by query in the document read from r to w,
+// one per line. Like Each, values selected by a path are written as soon as
+// they are read instead of being kept until the end of the document.
+func Stream(w io.Writer, r io.Reader, query string, opts ...Option) error {
+	return NewEngine(opts...).Stream(w, r, query)
+}
+
+func Decode(r io.Reader, query string, opts ...Option) (interface{}, error) {
+	return NewEngine(opts...).Decode(r, query)
 }
 
 func execute(r io.Reader, q Query) error {
@@ -45,20 +84,79 @@ func execute(r io.Reader, q Query) error {
 	return rs.Read(q)
 }
 
+// environ gives the options and the context of an execution to the queries
+// reading the values they are given by themselves, like the stages of a
+// pipeline.
+type environ struct {
+	cfg Engine
+	ctx context.Context
+}
+
+func bind(q Query, env *environ) {
+	Walk(q, func(q Query) bool {
+		switch q := q.(type) {
+		case *pipeline:
+			q.env = env
+		case *reduce:
+			q.env = env
+		}
+		return true
+	})
+}
+
+// executeString applies q to a value already in memory. The buffer of the
+// reader is sized after the value instead of DefaultBufferSize since it is
+// called for each value given to the stages of a pipeline. env is nil when q
+// is not run by an engine.
+func executeString(str string, q Query, env *environ) error {
+	size := len(str)
+	if size > DefaultBufferSize {
+		size = DefaultBufferSize
+	}
+	rs := prepareSize(strings.NewReader(str), size)
+	if env != nil {
+		rs.cfg = env.cfg
+		rs.ctx = env.ctx
+	}
+	return rs.Read(q)
+}
+
+const checkEvery = 1 << 12
+
 type reader struct {
 	inner io.RuneScanner
 	file  string
 	depth int
 
+	ctx   context.Context
+	count int
+	cfg   Engine
+
 	prev      Position
 	curr      Position
+	size      int
 	keepBlank bool
+	// keepEscapes writes the escaped surrogate pairs of strings as they are
+	// instead of decoding them
+	keepEscapes bool
+	// unescape decodes all the escape sequences of strings, as needed when
+	// they are given as Go values
+	unescape bool
+	// emit is called with the query updated each time a value is selected
+	emit func(Query) error
+	// collect is given the values selected by a path, decoded as they are read
+	collect func(interface{})
 }
 
 func prepare(r io.Reader) *reader {
+	return prepareSize(r, DefaultBufferSize)
+}
+
+func prepareSize(r io.Reader, size int) *reader {
 	rs := reader{
-		inner: bufio.NewReader(r),
+		inner: skipBOM(bufio.NewReaderSize(r, size)),
 		file:  "<input>",
+		ctx:   context.Background(),
 	}
 	rs.curr.Line = 1
 	if n, ok := r.(interface{ Name() string }); ok {
@@ -68,20 +166,91 @@ func prepare(r io.Reader) *reader {
 }
 
 func (r *reader) Read(q Query) error {
-	if keepAll(q) {
+	if err := r.readOne(q); err != nil {
+		return err
+	}
+	return r.end()
+}
+
+func (r *reader) readAll(q Query) (string, error) {
+	var list []string
+	for {
+		curr := q.Clone()
+		if err := r.readOne(curr); err != nil {
+			return "", err
+		}
+		if str := curr.String(); str != "" && len(curr.Get()) > 0 {
+			str, err := r.cfg.output(str)
+			if err != nil {
+				return "", err
+			}
+			list = append(list, str)
+		}
+		ok, err := r.more()
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			break
+		}
+	}
+	return r.cfg.finish(strings.Join(list, "\n")), nil
+}
+
+func (r *reader) readOne(q Query) error {
+	if keepAll(q) || isTransform(q) {
 		r.wrap()
-		defer r.update(q, "")
 	}
 	err := r.traverse(q)
+	if e := r.ctx.Err(); e != nil {
+		return e
+	}
 	if err != nil {
 		return err
 	}
-	if _, err = r.read(); err == nil {
-		return r.malformed("malformed JSON document: unexpected end")
+	if keepAll(q) || isTransform(q) {
+		return r.update(q, "")
 	}
 	return nil
 }
 
+// more skips the blanks after a document and reports whether another document
+// follows.
+func (r *reader) more() (bool, error) {
+	r.toggleBlank()
+	defer r.toggleBlank()
+	for {
+		c, err := r.read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return false, nil
+			}
+			return false, err
+		}
+		if !jsonBlank(c) {
+			r.unread()
+			return true, nil
+		}
+	}
+}
+
+func (r *reader) end() error {
+	r.toggleBlank()
+	defer r.toggleBlank()
+	for {
+		c, err := r.read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if !jsonBlank(c) {
+			return r.malformed("malformed JSON document: unexpected character %c after end of document", c)
+		}
+	}
+}
+
 func (r *reader) traverse(q Query) error {
 	c, err := r.read()
 	if err != nil {
@@ -89,11 +258,17 @@ func (r *reader) traverse(q Query) error {
 	}
 	switch {
 	case jsonQuote(c):
-		_, err = r.literal()
+		if err = r.check(q, "string"); err == nil {
+			_, err = r.literal()
+		}
 	case jsonIdent(c):
-		_, err = r.identifier()
-	case jsonDigit(c):
-		_, err = r.number()
+		if err = r.check(q, "literal"); err == nil {
+			_, err = r.identifier()
+		}
+	case jsonNumber(c):
+		if err = r.check(q, "number"); err == nil {
+			_, err = r.number()
+		}
 	case jsonArray(c):
 		err = r.array(q)
 	case jsonObject(c):
@@ -119,18 +294,48 @@ func (r *reader) key() (string, error) {
 	return key, nil
 }
 
+// keys gives the set used to detect duplicate keys in an object or nil if
+// duplicate keys are allowed.
+func (r *reader) keys() map[string]struct{} {
+	if !r.cfg.RejectDuplicates {
+		return nil
+	}
+	return make(map[string]struct{})
+}
+
+func (r *reader) unique(seen map[string]struct{}, key string) error {
+	if seen == nil {
+		return nil
+	}
+	if _, ok := seen[key]; ok {
+		return r.malformed("object: duplicate key %q", key)
+	}
+	seen[key] = struct{}{}
+	return nil
+}
+
 func (r *reader) object(q Query) error {
-	if err := canObject(q); err != nil {
+	if err := r.check(q, "object"); err != nil {
+		return err
+	}
+	if err := r.enter(); err != nil {
 		return err
 	}
-	r.enter()
 	defer r.leave()
 
+	if c, _ := r.read(); c == '}' {
+		return nil
+	}
+	r.unread()
+	seen := r.keys()
 	for {
 		key, err := r.key()
 		if err != nil {
 			return err
 		}
+		if err := r.unique(seen, key); err != nil {
+			return err
+		}
 		if err = r.filter(q, key); err != nil {
 			return err
 		}
@@ -159,17 +364,26 @@ func (r *reader) endObject() error {
 }
 
 func (r *reader) array(q Query) error {
-	r.enter()
+	if err := r.enter(); err != nil {
+		return err
+	}
 	defer r.leave()
 
-	if err := canArray(q); err != nil {
+	if err := r.check(q, "array"); err != nil {
 		return err
 	}
+	if c, _ := r.read(); c == ']' {
+		return nil
+	}
+	r.unread()
 	for i := 0; ; i++ {
 		err := r.filter(q, strconv.Itoa(i))
 		if err != nil {
 			return err
 		}
+		if selected(q) {
+			q = nil
+		}
 		if err := r.endArray(); err != nil {
 			if isDone(err) {
 				break
@@ -203,15 +417,36 @@ func (r *reader) filter(q Query, key string) error {
 		return r.traverse(next)
 	}
 	if !keepAll(q) && next == nil {
+		if r.collect != nil {
+			v, err := r.decode()
+			if err != nil {
+				return err
+			}
+			r.collect(v)
+			return nil
+		}
 		r.wrap()
-		defer r.update(q, key)
+		if err := r.traverse(next); err != nil {
+			return err
+		}
+		if err := r.update(q, key); err != nil {
+			return err
+		}
+		if r.emit != nil {
+			return r.emit(q)
+		}
+		return nil
 	}
 	return r.traverse(next)
 }
 
 func (r *reader) update(q Query, key string) error {
 	str := r.unwrap()
-	return q.update(str)
+	err := q.update(str)
+	if err != nil && !isMalformed(err) {
+		err = r.malformed("%s", err)
+	}
+	return err
 }
 
 func (r *reader) literal() (string, error) {
@@ -233,39 +468,123 @@ func (r *reader) literal() (string, error) {
 			}
 			continue
 		}
+		if r.cfg.Strict {
+			if err := r.checkRune(c); err != nil {
+				return "", err
+			}
+		}
 		buf.WriteRune(c)
 	}
 	return buf.String(), nil
 }
 
+func (r *reader) checkRune(c rune) error {
+	if c < 0x20 {
+		return r.malformed("unescaped control character %U in string", c)
+	}
+	if c == utf8.RuneError && r.size == 1 {
+		return r.malformed("invalid UTF-8 sequence in string")
+	}
+	return nil
+}
+
 func (r *reader) toggleBlank() {
 	r.keepBlank = !r.keepBlank
 }
 
 func (r *reader) escape(buf *bytes.Buffer) error {
-	buf.WriteRune('\\')
 	switch c, _ := r.read(); c {
-	case 'n', 'f', 'b', 'r', '"', '\\', '/':
+	case 'n', 'f', 'b', 'r', 't', '"', '\\', '/':
+		if r.unescape {
+			buf.WriteRune(unescapeRune(c))
+			break
+		}
+		buf.WriteRune('\\')
 		buf.WriteRune(c)
 	case 'u':
-		buf.WriteRune(c)
-		for i := 0; i < 4; i++ {
-			c, _ = r.read()
-			if !jsonHex(c) {
-				return r.malformed("%c not a hex character", c)
-			}
+		hex, err := r.hex()
+		if err != nil {
+			return err
+		}
+		c := decodeHex(hex)
+		if !utf16.IsSurrogate(c) && r.unescape {
 			buf.WriteRune(c)
+			break
+		}
+		if !utf16.IsSurrogate(c) {
+			buf.WriteString("\\u")
+			buf.WriteString(hex)
+			break
+		}
+		if c >= 0xDC00 {
+			return r.malformed("unpaired low surrogate \\u%s", hex)
 		}
+		if c, _ := r.read(); c != '\\' {
+			return r.malformed("unpaired high surrogate \\u%s", hex)
+		}
+		if c, _ := r.read(); c != 'u' {
+			return r.malformed("unpaired high surrogate \\u%s", hex)
+		}
+		low, err := r.hex()
+		if err != nil {
+			return err
+		}
+		c = utf16.DecodeRune(c, decodeHex(low))
+		if c == utf8.RuneError {
+			return r.malformed("invalid surrogate pair \\u%s\\u%s", hex, low)
+		}
+		if r.keepEscapes {
+			buf.WriteString("\\u" + hex + "\\u" + low)
+			break
+		}
+		buf.WriteRune(c)
 	default:
 		return r.malformed("unknown escape \\%c", c)
 	}
 	return nil
 }
 
+func (r *reader) hex() (string, error) {
+	var str strings.Builder
+	for i := 0; i < 4; i++ {
+		c, _ := r.read()
+		if !jsonHex(c) {
+			return "", r.malformed("%c not a hex character", c)
+		}
+		str.WriteRune(c)
+	}
+	return str.String(), nil
+}
+
+func unescapeRune(c rune) rune {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'f':
+		return '\f'
+	case 'b':
+		return '\b'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	default:
+		return c
+	}
+}
+
+func decodeHex(str string) rune {
+	n, _ := strconv.ParseUint(str, 16, 32)
+	return rune(n)
+}
+
 func (r *reader) identifier() (interface{}, error) {
 	defer r.unread()
 	r.unread()
 
+	r.toggleBlank()
+	defer r.toggleBlank()
+
 	var buf bytes.Buffer
 	for {
 		c, err := r.read()
@@ -297,28 +616,40 @@ func (r *reader) number() (string, error) {
 		buf bytes.Buffer
 		err error
 	)
+	r.toggleBlank()
+	defer r.toggleBlank()
+
 	r.unread()
-	if c, _ := r.read(); c == '0' {
+	c, _ := r.read()
+	switch c {
+	case '-':
 		buf.WriteRune(c)
-		if c, _ = r.read(); c == '.' {
-			err := r.fraction(&buf)
-			return buf.String(), err
-		} else if jsonBlank(c) || c == ',' || c == '}' || c == ']' {
-			r.unread()
-			return buf.String(), nil
+		c, _ = r.read()
+	case '+':
+		if !r.cfg.Lenient {
+			return "", r.malformed("unexpected '+' before number")
 		}
-		return "", r.malformed("expected fraction after 0")
+		r.forget()
+		c, _ = r.read()
 	}
-	r.unread()
-	for {
-		c, _ := r.read()
-		if !jsonDigit(c) {
-			break
+	if !jsonDigit(c) {
+		return "", r.malformed("expected digit instead of %c", c)
+	}
+	buf.WriteRune(c)
+	if c == '0' {
+		if c, _ = r.read(); jsonDigit(c) {
+			return "", r.malformed("unexpected digit after leading 0")
+		}
+	} else {
+		for {
+			c, _ = r.read()
+			if !jsonDigit(c) {
+				break
+			}
+			buf.WriteRune(c)
 		}
-		buf.WriteRune(c)
 	}
-	r.unread()
-	switch c, _ := r.read(); c {
+	switch c {
 	case '.':
 		err = r.fraction(&buf)
 	case 'e', 'E':
@@ -363,8 +694,8 @@ func (r *reader) exponent(buf *bytes.Buffer, exp rune) error {
 		buf.WriteRune(c)
 		c, _ = r.read()
 	}
-	if !jsonDigit(c) || c == '0' {
-		return r.malformed("expected digit (different of 0) after exponent")
+	if !jsonDigit(c) {
+		return r.malformed("expected digit after exponent")
 	}
 	buf.WriteRune(c)
 	for {
@@ -377,8 +708,12 @@ func (r *reader) exponent(buf *bytes.Buffer, exp rune) error {
 	return nil
 }
 
-func (r *reader) enter() {
+func (r *reader) enter() error {
+	if limit := r.cfg.maxDepth(); limit > 0 && r.depth >= limit {
+		return r.malformed("maximum nesting depth (%d) exceeded", limit)
+	}
 	r.depth++
+	return nil
 }
 
 func (r *reader) leave() {
@@ -387,7 +722,13 @@ func (r *reader) leave() {
 
 func (r *reader) read() (rune, error) {
 	for {
-		c, _, err := r.inner.ReadRune()
+		if r.count++; r.count%checkEvery == 1 {
+			if err := r.ctx.Err(); err != nil {
+				return 0, err
+			}
+		}
+		c, z, err := r.inner.ReadRune()
+		r.size = z
 		r.prev = r.curr
 		if c == '\n' {
 			r.curr.Line++
@@ -400,8 +741,16 @@ func (r *reader) read() (rune, error) {
 	}
 }
 
+func (r *reader) forget() {
+	if w, ok := r.inner.(*compact); ok {
+		w.forget()
+	}
+}
+
 func (r *reader) unread() {
-	r.inner.UnreadRune()
+	if r.inner.UnreadRune() == nil {
+		r.curr = r.prev
+	}
 }
 
 func (r *reader) wrap() {
@@ -431,30 +780,134 @@ func isDone(err error) bool {
 	return errors.Is(err, errDone)
 }
 
-func canObject(q Query) error {
-	// if q == nil {
-	// 	return nil
-	// }
-	// switch q.(type) {
-	// case *all, *ident, *any, *object, *array:
-	// 	return nil
-	// default:
-	// 	return invalidQueryForType("object")
-	// }
+func isMalformed(err error) bool {
+	var e MalformedError
+	return errors.As(err, &e)
+}
+
+// check reports the queries that can not select anything in the value being
+// read when StrictTypes is set. The builtins that need an array (first, last,
+// add) are always reported.
+func (r *reader) check(q Query, kind string) error {
+	err := canBuiltin(q, kind)
+	if err == nil && r.cfg.StrictTypes {
+		switch kind {
+		case "object":
+			err = canObject(q)
+		case "array":
+			err = canArray(q)
+		default:
+			err = canScalar(q, kind)
+		}
+	}
+	if err != nil {
+		return r.malformed("%s", err)
+	}
 	return nil
 }
 
+func canObject(q Query) error {
+	switch q := q.(type) {
+	case *index:
+		if len(q.list) == 0 {
+			return nil
+		}
+		for _, k := range q.list {
+			if _, err := strconv.Atoi(k); err != nil {
+				return nil
+			}
+		}
+		return invalidQueryForType("object")
+	case *edge:
+		return invalidQueryForType("object")
+	case *pipeline:
+		return canObject(q.Query)
+	case *ptr:
+		return canObject(q.Query)
+	default:
+		return nil
+	}
+}
+
 func canArray(q Query) error {
-	// if q == nil {
-	// 	return nil
-	// }
-	// switch q.(type) {
-	// case *all, *index, *array:
-	// 	return nil
-	// default:
-	// 	return invalidQueryForType("array")
-	// }
-	return nil
+	switch q := q.(type) {
+	case *ident:
+		return invalidQueryForType("array")
+	case *index:
+		for _, k := range q.list {
+			if _, err := strconv.Atoi(k); err != nil {
+				return invalidQueryForType("array")
+			}
+		}
+		return nil
+	case *pipeline:
+		return canArray(q.Query)
+	case *ptr:
+		return canArray(q.Query)
+	default:
+		return nil
+	}
+}
+
+func canBuiltin(q Query, kind string) error {
+	switch q := q.(type) {
+	case *edge:
+		if kind == "array" {
+			return nil
+		}
+		return invalidQueryForType(kind)
+	case *add:
+		if kind == "array" || kind == "object" {
+			return nil
+		}
+		return fmt.Errorf("add: array expected")
+	case *pipeline:
+		return canBuiltin(q.Query, kind)
+	case *ptr:
+		return canBuiltin(q.Query, kind)
+	default:
+		return nil
+	}
+}
+
+func canScalar(q Query, kind string) error {
+	switch q := q.(type) {
+	case *ident, *index, *edge:
+		return invalidQueryForType(kind)
+	case *pipeline:
+		return canScalar(q.Query, kind)
+	case *ptr:
+		return canScalar(q.Query, kind)
+	default:
+		return nil
+	}
+}
+
+const bom = '\uFEFF'
+
+// bomReader drops the byte order mark that some tools write at the start of
+// UTF-8 documents.
+type bomReader struct {
+	*bufio.Reader
+	start bool
+}
+
+func skipBOM(r *bufio.Reader) io.RuneScanner {
+	return &bomReader{
+		Reader: r,
+		start:  true,
+	}
+}
+
+func (r *bomReader) ReadRune() (rune, int, error) {
+	c, z, err := r.Reader.ReadRune()
+	if r.start {
+		r.start = false
+		if err == nil && c == bom {
+			return r.Reader.ReadRune()
+		}
+	}
+	return c, z, err
 }
 
 type unwrapper interface {
@@ -468,6 +921,12 @@ type compact struct {
 	last    rune
 	scanstr bool
 	buf     bytes.Buffer
+
+	state struct {
+		last    rune
+		scanstr bool
+		written int
+	}
 }
 
 func wrap(rs io.RuneScanner) io.RuneScanner {
@@ -485,6 +944,10 @@ func (w *compact) String() string {
 
 func (w *compact) ReadRune() (rune, int, error) {
 	c, z, err := w.RuneScanner.ReadRune()
+	w.state.last = w.last
+	w.state.scanstr = w.scanstr
+	w.state.written = w.buf.Len()
+
 	w.toggle(c)
 	if err == nil && w.keep(c) {
 		w.buf.WriteRune(c)
@@ -493,23 +956,26 @@ func (w *compact) ReadRune() (rune, int, error) {
 			w.last = c
 		}
 	}
+	w.state.written = w.buf.Len() - w.state.written
 	return c, z, err
 }
 
 func (w *compact) UnreadRune() error {
 	err := w.RuneScanner.UnreadRune()
-	if err == nil && w.buf.Len() > 0 {
-		var size int
-		if !w.scanstr && jsonSep(w.last) {
-			size++
-		}
-		size++
-		w.buf.Truncate(w.buf.Len() - size)
-		w.toggle(w.last)
+	if err == nil {
+		w.buf.Truncate(w.buf.Len() - w.state.written)
+		w.last = w.state.last
+		w.scanstr = w.state.scanstr
+		w.state.written = 0
 	}
 	return err
 }
 
+func (w *compact) forget() {
+	w.buf.Truncate(w.buf.Len() - w.state.written)
+	w.state.written = 0
+}
+
 func (w *compact) Unwrap() io.RuneScanner {
 	return w.RuneScanner
 }
@@ -549,6 +1015,10 @@ func jsonDigit(r rune) bool {
 	return r >= '0' && r <= '9'
 }
 
+func jsonNumber(r rune) bool {
+	return jsonDigit(r) || r == '-' || r == '+'
+}
+
 func jsonIdent(r rune) bool {
 	return r == 't' || r == 'f' || r == 'n'
 }
@@ -1,6 +1,15 @@
 package query
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -126,6 +135,341 @@ func TestFilter(t *testing.T) {
 			Query: `.user | . | .score`,
 			Want:  `42`,
 		},
+		{
+			Input: `{"token": "Zm9vYmFy"}`,
+			Query: `.token | @base64d`,
+			Want:  `"foobar"`,
+		},
+		{
+			Input: `{"user": "foobar"}`,
+			Query: `.user | @base64`,
+			Want:  `"Zm9vYmFy"`,
+		},
+		{
+			Input: `"foobar"`,
+			Query: `@base64 | @base64d`,
+			Want:  `"foobar"`,
+		},
+		{
+			Input: `{"scores": [1, 2.5, 3]}`,
+			Query: `.scores | add`,
+			Want:  `6.5`,
+		},
+		{
+			Input: `{"parts": ["foo", "bar"]}`,
+			Query: `.parts | add`,
+			Want:  `"foobar"`,
+		},
+		{
+			Input: `[1, null, 2]`,
+			Query: `add`,
+			Want:  `3`,
+		},
+		{
+			Input: `[]`,
+			Query: `add`,
+			Want:  `null`,
+		},
+		{
+			Input: "{\"user\": \"foobar\"}\n",
+			Query: `.user`,
+			Want:  `"foobar"`,
+		},
+		{
+			Input: "{\"user\": \"foobar\"} \t\r\n\n",
+			Query: `.`,
+			Want:  `{"user": "foobar"}`,
+		},
+		{
+			Input: "0\n",
+			Query: `.`,
+			Want:  `0`,
+		},
+		{
+			Input: "true \t",
+			Query: `.`,
+			Want:  `true`,
+		},
+		{
+			Input: "[1, 2]\n\n",
+			Query: `.[1]`,
+			Want:  `2`,
+		},
+		{
+			Input: `-0`,
+			Query: `.`,
+			Want:  `-0`,
+		},
+		{
+			Input: `-12.5e3`,
+			Query: `.`,
+			Want:  `-12.5e3`,
+		},
+		{
+			Input: `{"lat": -0.5, "exp": 1E05, "zero": 0e1}`,
+			Query: `.lat,.exp,.zero`,
+			Want:  `[-0.5, 1E05, 0e1]`,
+		},
+		{
+			Input: `[-1, 2.5, -3]`,
+			Query: `add`,
+			Want:  `-1.5`,
+		},
+		{
+			Input: `{"first-name": "foo", "last name": "bar", "user.id": 42}`,
+			Query: `.["first-name"]`,
+			Want:  `"foo"`,
+		},
+		{
+			Input: `{"user": {"first-name": "foo", "last name": "bar", "user.id": 42}}`,
+			Query: `.user["last name", "user.id"]`,
+			Want:  `["bar", 42]`,
+		},
+		{
+			Input: `[{"user.name": "foo"}, {"user.name": "bar"}]`,
+			Query: `.[1]["user.name"]`,
+			Want:  `"bar"`,
+		},
+		{
+			Input: `{"user": "foobar", "active": true}`,
+			Query: `.active | not`,
+			Want:  `false`,
+		},
+		{
+			Input: `false`,
+			Query: `not`,
+			Want:  `true`,
+		},
+		{
+			Input: `true`,
+			Query: `not | not`,
+			Want:  `true`,
+		},
+		{
+			Input: `{"smiley": "\ud83d\ude00", "tab": "a\tb", "e": "\u00e9"}`,
+			Query: `.smiley, .tab, .e`,
+			Want:  `["\ud83d\ude00", "a\tb", "\u00e9"]`,
+		},
+		{
+			Input: `{"\ud83d\ude00": 42}`,
+			Query: `.["😀"]`,
+			Want:  `42`,
+		},
+		{
+			Input: `{"name": "foo", "tags": ["a", "b"], "meta": {"id": 1}}`,
+			Query: `to_entries`,
+			Want:  `[{"key": "name", "value": "foo"}, {"key": "tags", "value": ["a", "b"]}, {"key": "meta", "value": {"id": 1}}]`,
+		},
+		{
+			Input: `{}`,
+			Query: `to_entries`,
+			Want:  `[]`,
+		},
+		{
+			Input: `{"user": {"name": "foo", "age": 42}}`,
+			Query: `.user | to_entries | from_entries`,
+			Want:  `{"name": "foo", "age": 42}`,
+		},
+		{
+			Input: `[{"key": "a", "value": 1}, {"key": "b", "value": [true]}, {"key": "a", "value": {"x": 2}}, {"key": "c"}]`,
+			Query: `from_entries`,
+			Want:  `{"a": {"x": 2}, "b": [true], "c": null}`,
+		},
+		{
+			Input: `[]`,
+			Query: `from_entries`,
+			Want:  `{}`,
+		},
+		{
+			Input: `{"a": {"b": {"a": 1, "b": 2}, "a": 3}}`,
+			Query: `.a | .b | $`,
+			Want:  `1`,
+		},
+		{
+			Input: `{"a": {"b": {"a": 1, "b": 2}, "a": 3}}`,
+			Query: `.a | .b | $1`,
+			Want:  `2`,
+		},
+		{
+			Input: `{"a": {"b": {"a": 1, "b": 2}, "a": 3}}`,
+			Query: `.a | [.b, $0]`,
+			Want:  `[{"a": 1, "b": 2}, 3]`,
+		},
+		{
+			Input: `[{"a": {"a": 1}}, {"a": {"a": 2}}]`,
+			Query: `.[] | .a | $0`,
+			Want:  `[1, 2]`,
+		},
+		{
+			Input: `{"payload": "{\"user\": {\"name\": \"foo\"}, \"tags\": [1, 2]}"}`,
+			Query: `.payload | fromjson | .user.name`,
+			Want:  `"foo"`,
+		},
+		{
+			Input: `{"payload": "[1, 2]"}`,
+			Query: `{list: .payload | fromjson}`,
+			Want:  `{"list": [1, 2]}`,
+		},
+		{
+			Input: `{"user": {"name": "foo\nbar", "tags": [1, {"id": null}]}}`,
+			Query: `.user | tojson`,
+			Want:  `"{\"name\":\"foo\\nbar\",\"tags\":[1,{\"id\":null}]}"`,
+		},
+		{
+			Input: `{"user": {"name": "foo"}}`,
+			Query: `.user | tojson | fromjson`,
+			Want:  `{"name": "foo"}`,
+		},
+		{
+			Input: `[72, 105]`,
+			Query: `.[] | ascii`,
+			Want:  `["H", "i"]`,
+		},
+		{
+			Input: `{"x": 1, "y": "pi", "z": true}`,
+			Query: `{"123": .x, "π": .y, "a \"b\"": .z}`,
+			Want:  `{"123": 1, "π": "pi", "a \"b\"": true}`,
+		},
+		{
+			Input: `{"temperature": -12.5}`,
+			Query: `.temperature | abs`,
+			Want:  `12.5`,
+		},
+		{
+			Input: `[-3, 0, 7, -2.5e3, -12345678901234567890, -0, -0.0]`,
+			Query: `.[] | abs`,
+			Want:  `[3, 0, 7, 2.5e3, 12345678901234567890, 0, 0.0]`,
+		},
+		{
+			Input: `[3, 3.0, 3.7, -3.2, -0.5e1, 2e-1]`,
+			Query: `.[] | floor`,
+			Want:  `[3, 3, 3, -4, -5, 0]`,
+		},
+		{
+			Input: `[3, 3.0, 3.2, -3.7, 2e-1]`,
+			Query: `.[] | ceil`,
+			Want:  `[3, 3, 4, -3, 1]`,
+		},
+		{
+			Input: `{"min": 19.99, "max": 24.01}`,
+			Query: `{min: .min | floor, max: .max | ceil}`,
+			Want:  `{"min": 19, "max": 25}`,
+		},
+		{
+			Input: `{"items": [{"name": "foo"}, {"name": "bar"}, {"name": "baz"}]}`,
+			Query: `.items | first`,
+			Want:  `{"name": "foo"}`,
+		},
+		{
+			Input: `{"items": [{"name": "foo"}, {"name": "bar"}, {"name": "baz"}]}`,
+			Query: `.items | last | .name`,
+			Want:  `"baz"`,
+		},
+		{
+			Input: `{"items": [{"name": "foo"}, {"name": "bar"}, {"name": "baz"}]}`,
+			Query: `.items | first | .name`,
+			Want:  `"foo"`,
+		},
+		{
+			Input: `[[1, 2], [3], []]`,
+			Query: `[.[] | last]`,
+			Want:  `[2, 3]`,
+		},
+		{
+			Input: `[42]`,
+			Query: `first`,
+			Want:  `42`,
+		},
+		{
+			Input: `[42]`,
+			Query: `last`,
+			Want:  `42`,
+		},
+		{
+			Input: `[]`,
+			Query: `first`,
+			Want:  ``,
+		},
+		{
+			Input: `[]`,
+			Query: `last`,
+			Want:  ``,
+		},
+		{
+			Input: `{"users": ["Alice", "bob", "anna"]}`,
+			Query: `.users[] | test("^a")`,
+			Want:  `[false, false, true]`,
+		},
+		{
+			Input: `{"users": ["Alice", "bob", "anna"]}`,
+			Query: `.users[] | test("^a", "i")`,
+			Want:  `[true, false, true]`,
+		},
+		{
+			Input: `{"name": "foo  bar baz"}`,
+			Query: `.name | sub("\\s+", "_")`,
+			Want:  `"foo_bar baz"`,
+		},
+		{
+			Input: `{"name": "foo  bar baz"}`,
+			Query: `.name | gsub("\\s+", "_")`,
+			Want:  `"foo_bar_baz"`,
+		},
+		{
+			Input: `{"name": "foo  bar baz"}`,
+			Query: `.name | sub("\\s+", "_", "g")`,
+			Want:  `"foo_bar_baz"`,
+		},
+		{
+			Input: `{"name": "doe, john"}`,
+			Query: `.name | sub("(?P<last>\\w+), (\\w+)", "$2 ${last}")`,
+			Want:  `"john doe"`,
+		},
+		{
+			Input: `{"name": "foo", "id": "x1"}`,
+			Query: `{match: .name | test("o+"), id: .id | sub("x", "y")}`,
+			Want:  `{"match": true, "id": "y1"}`,
+		},
+		{
+			Input: `[3, "b", 1, null, 3, true, "a", false, 1, [1], {"a": 1}, 2.5, "b", [1]]`,
+			Query: `unique`,
+			Want:  `[null, false, true, 1, 2.5, 3, "a", "b", [1], {"a": 1}]`,
+		},
+		{
+			Input: `{"items": [{"cat": "b", "id": 1}, {"cat": "a", "id": 2}, {"cat": "b", "id": 3}, {"cat": "a", "id": 4}]}`,
+			Query: `.items | unique_by(.cat)`,
+			Want:  `[{"cat": "a", "id": 2}, {"cat": "b", "id": 1}]`,
+		},
+		{
+			Input: `{"items": [{"cat": "b", "id": 1}, {"cat": "a", "id": 2}, {"cat": "b", "id": 3}, {"cat": "a", "id": 4}]}`,
+			Query: `.items | group_by(.cat)`,
+			Want:  `[[{"cat": "a", "id": 2}, {"cat": "a", "id": 4}], [{"cat": "b", "id": 1}, {"cat": "b", "id": 3}]]`,
+		},
+		{
+			Input: `[{"n": 10}, {"n": 9}, {"n": 10.0}, {"n": 2}]`,
+			Query: `unique_by(.n) | .[].n`,
+			Want:  `[2, 9, 10]`,
+		},
+		{
+			Input: `[3, 1.5, -2, 10, 1]`,
+			Query: `sort`,
+			Want:  `[-2, 1, 1.5, 3, 10]`,
+		},
+		{
+			Input: `["b", 2, {"a": 1}, null, [2], true, "a", [1, 2], false, {"a": 0, "b": 1}, {"a": 0}]`,
+			Query: `sort`,
+			Want:  `[null, false, true, 2, "a", "b", [1, 2], [2], {"a": 0}, {"a": 1}, {"a": 0, "b": 1}]`,
+		},
+		{
+			Input: `{"users": [{"name": "foo", "age": 42}, {"name": "bar"}, {"name": "baz", "age": 7}, {"name": "qux", "age": null}, {"name": "quux", "age": 7}]}`,
+			Query: `.users | sort_by(.age) | .[].name`,
+			Want:  `["bar", "qux", "baz", "quux", "foo"]`,
+		},
+		{
+			Input: `[]`,
+			Query: `sort`,
+			Want:  `[]`,
+		},
 	}
 	for _, q := range queries {
 		got, err := Execute(strings.NewReader(q.Input), q.Query)
@@ -138,3 +482,1420 @@ func TestFilter(t *testing.T) {
 		}
 	}
 }
+
+func TestRegisterFormat(t *testing.T) {
+	RegisterFormat("upper", func(str string) (string, error) {
+		return strings.ToUpper(str), nil
+	})
+	got, err := Execute(strings.NewReader(`{"user": "foo"}`), `.user | @upper`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := `"FOO"`; got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic when registering base64 again")
+		}
+	}()
+	RegisterFormat("base64", runEncodeB64)
+}
+
+func TestFilter_Error(t *testing.T) {
+	queries := []struct {
+		Input string
+		Query string
+	}{
+		{
+			Input: `{"token": "not base64!"}`,
+			Query: `.token | @base64d`,
+		},
+		{
+			Input: `42`,
+			Query: `@base64d`,
+		},
+		{
+			Input: `{"list": [1, "foo"]}`,
+			Query: `.list | add`,
+		},
+		{
+			Input: `5`,
+			Query: `add`,
+		},
+		{
+			Input: `{"name": "foo"}`,
+			Query: `.name | add`,
+		},
+		{
+			Input: `{"user": "foobar"}`,
+			Query: `.user | not`,
+		},
+		{
+			Input: `null`,
+			Query: `not`,
+		},
+		{
+			Input: `[1, 2]`,
+			Query: `to_entries`,
+		},
+		{
+			Input: `{"payload": "{\"user\": "}`,
+			Query: `.payload | fromjson`,
+		},
+		{
+			Input: `{"payload": 42}`,
+			Query: `.payload | fromjson`,
+		},
+		{
+			Input: `{"code": 200}`,
+			Query: `.code | ascii`,
+		},
+		{
+			Input: `{"price": "19.99"}`,
+			Query: `.price | floor`,
+		},
+		{
+			Input: `[true]`,
+			Query: `.[] | abs`,
+		},
+		{
+			Input: `{"price": null}`,
+			Query: `.price | ceil`,
+		},
+		{
+			Input: `{"code": 200}`,
+			Query: `.code | test("2")`,
+		},
+		{
+			Input: `{"items": {"a": 1}}`,
+			Query: `.items | unique`,
+		},
+		{
+			Input: `{"items": 42}`,
+			Query: `.items | group_by(.cat)`,
+		},
+		{
+			Input: `{"items": "foo"}`,
+			Query: `.items | sort`,
+		},
+		{
+			Input: `{"smiley": "\ud83d"}`,
+			Query: `.smiley`,
+		},
+		{
+			Input: `{"smiley": "\ud83dx"}`,
+			Query: `.smiley`,
+		},
+		{
+			Input: `{"smiley": "\ud83d\u0041"}`,
+			Query: `.smiley`,
+		},
+		{
+			Input: `{"smiley": "\ude00"}`,
+			Query: `.smiley`,
+		},
+		{
+			Input: `[{"key": 1, "value": 2}]`,
+			Query: `from_entries`,
+		},
+		{
+			Input: "{\"user\": \"foobar\"}\n x",
+			Query: `.user`,
+		},
+		{
+			Input: "true x",
+			Query: `.`,
+		},
+		{
+			Input: "4 2",
+			Query: `.`,
+		},
+		{
+			Input: `01`,
+			Query: `.`,
+		},
+		{
+			Input: `{"a": -01}`,
+			Query: `.a`,
+		},
+		{
+			Input: `+1`,
+			Query: `.`,
+		},
+		{
+			Input: `[1, -]`,
+			Query: `.[]`,
+		},
+		{
+			Input: `1.`,
+			Query: `.`,
+		},
+		{
+			Input: `1e+`,
+			Query: `.`,
+		},
+	}
+	for _, q := range queries {
+		_, err := Execute(strings.NewReader(q.Input), q.Query)
+		if err == nil {
+			t.Errorf("%s: expected error but got none", q.Query)
+			continue
+		}
+		var e MalformedError
+		if !errors.As(err, &e) {
+			t.Errorf("%s: expected MalformedError, got %T", q.Query, err)
+		}
+	}
+}
+
+func TestExecuteNewline(t *testing.T) {
+	input := `{"user": "foobar"}`
+	got, err := Execute(strings.NewReader(input), `.user`, TrailingNewline(true))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "\"foobar\"\n"; got != want {
+		t.Errorf("result mismatched! want %q, got %q", want, got)
+	}
+	got, err = Execute(strings.NewReader(input), `.user`, TrailingNewline(false))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := `"foobar"`; got != want {
+		t.Errorf("result mismatched! want %q, got %q", want, got)
+	}
+
+	got, err = ExecuteLine(strings.NewReader(`{"user": "foo"} {"user": "bar"}`), `.user`, MultiDocument(true))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "\"foo\"\n\"bar\"\n"; got != want {
+		t.Errorf("result mismatched! want %q, got %q", want, got)
+	}
+
+	var e Engine
+	e.Newline = true
+	if got, want := e.finish("foo\n"), "foo\n"; got != want {
+		t.Errorf("newline doubled! want %q, got %q", want, got)
+	}
+}
+
+func TestLenientNumbers(t *testing.T) {
+	data := []struct {
+		Input string
+		Query string
+		Want  string
+	}{
+		{
+			Input: `+1`,
+			Query: `.`,
+			Want:  `1`,
+		},
+		{
+			Input: `{"a": +2.5, "b": -1}`,
+			Query: `.`,
+			Want:  `{"a": 2.5, "b": -1}`,
+		},
+		{
+			Input: `{"a": +2.5, "b": -1}`,
+			Query: `. | .a`,
+			Want:  `2.5`,
+		},
+	}
+	for _, d := range data {
+		got, err := Execute(strings.NewReader(d.Input), d.Query, LenientNumbers(true))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Input, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%s: result mismatched! want %s, got %s", d.Input, d.Want, got)
+		}
+	}
+}
+
+func TestMultiDocument(t *testing.T) {
+	data := []struct {
+		Input string
+		Query string
+		Want  string
+	}{
+		{
+			Input: `{"a":1}{"a":2}`,
+			Query: `.a`,
+			Want:  "1\n2",
+		},
+		{
+			Input: `{"a": 1}{"b": 2}`,
+			Query: `.`,
+			Want:  "{\"a\": 1}\n{\"b\": 2}",
+		},
+		{
+			Input: `{"a":1}{"b":2}{"a":3}`,
+			Query: `.a`,
+			Want:  "1\n3",
+		},
+		{
+			Input: "1 \"foo\"{\"a\":[true]}\n[null]",
+			Query: `.`,
+			Want:  "1\n\"foo\"\n{\"a\": [true]}\n[null]",
+		},
+		{
+			Input: `{"a":true}{"a":false}`,
+			Query: `.a | not`,
+			Want:  "false\ntrue",
+		},
+	}
+	for _, d := range data {
+		got, err := Execute(strings.NewReader(d.Input), d.Query, MultiDocument(true))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Input, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%s: result mismatched! want %q, got %q", d.Input, d.Want, got)
+		}
+	}
+	if _, err := Execute(strings.NewReader(`{"a":1}{"a":`), `.a`, MultiDocument(true)); err == nil {
+		t.Errorf("truncated document: expected error but got none")
+	}
+}
+
+func TestStrictStrings(t *testing.T) {
+	data := []struct {
+		Input string
+		Valid bool
+	}{
+		{Input: `{"user": "foo\tbar"}`, Valid: true},
+		{Input: `{"user": "caf\u00e9 café"}`, Valid: true},
+		{Input: "{\"user\": \"foo\tbar\"}", Valid: false},
+		{Input: "{\"user\": \"foo\nbar\"}", Valid: false},
+		{Input: "{\"user\": \"foo\xffbar\"}", Valid: false},
+		{Input: "{\"us\x01er\": \"foobar\"}", Valid: false},
+	}
+	for _, d := range data {
+		_, err := Execute(strings.NewReader(d.Input), `.user`, StrictStrings(true))
+		if d.Valid && err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Input, err)
+		}
+		if d.Valid {
+			continue
+		}
+		var e MalformedError
+		if !errors.As(err, &e) {
+			t.Errorf("%q: expected MalformedError, got %v", d.Input, err)
+			continue
+		}
+		if e.Line == 0 || e.Col == 0 {
+			t.Errorf("%q: invalid position %s", d.Input, e.Position)
+		}
+		if _, err := Execute(strings.NewReader(d.Input), `.user`); err != nil {
+			t.Errorf("%q: unexpected error in lenient mode: %s", d.Input, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	data := []struct {
+		Input string
+		Valid bool
+	}{
+		{Input: `{"user": "foobar", "scores": [1, 2.5, {"x": null}]}`, Valid: true},
+		{Input: "[true, false]\n", Valid: true},
+		{Input: `{"user": "foobar"} x`, Valid: false},
+		{Input: `{"a": [1, {"b": [[`, Valid: false},
+		{Input: `{"a": [1, {"b":`, Valid: false},
+		{Input: `"foobar`, Valid: false},
+		{Input: `[1,]`, Valid: false},
+		{Input: ``, Valid: false},
+	}
+	for _, d := range data {
+		err := Validate(strings.NewReader(d.Input))
+		if d.Valid {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %s", d.Input, err)
+			}
+			continue
+		}
+		var e MalformedError
+		if !errors.As(err, &e) {
+			t.Errorf("%q: expected MalformedError, got %v", d.Input, err)
+		}
+	}
+}
+
+func TestValidateMultiDocument(t *testing.T) {
+	data := []struct {
+		Input string
+		Valid bool
+	}{
+		{Input: `{"a": 1} {"a": 2}`, Valid: true},
+		{Input: "[1]\n[2]\n", Valid: true},
+		{Input: `{"a": 1} {"a": }`, Valid: false},
+		{Input: `{"a": 1} {"a": 2`, Valid: false},
+		{Input: `{"a": 1} [1,]`, Valid: false},
+	}
+	for _, d := range data {
+		err := Validate(strings.NewReader(d.Input), MultiDocument(true))
+		if d.Valid {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %s", d.Input, err)
+			}
+			continue
+		}
+		var e MalformedError
+		if !errors.As(err, &e) {
+			t.Errorf("%q: expected MalformedError, got %v", d.Input, err)
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	nested := func(n int) string {
+		return strings.Repeat("[", n) + strings.Repeat("]", n)
+	}
+	data := []struct {
+		Input string
+		Depth int
+		Valid bool
+	}{
+		{Input: nested(DefaultMaxDepth * 2), Valid: false},
+		{Input: nested(DefaultMaxDepth), Valid: true},
+		{Input: nested(DefaultMaxDepth * 2), Depth: -1, Valid: true},
+		{Input: `{"a": [{"b": [1]}]}`, Depth: 4, Valid: true},
+		{Input: `{"a": [{"b": [1]}]}`, Depth: 3, Valid: false},
+	}
+	for _, d := range data {
+		_, err := Execute(strings.NewReader(d.Input), `.`, MaxDepth(d.Depth))
+		if d.Valid {
+			if err != nil {
+				t.Errorf("depth %d: unexpected error: %s", d.Depth, err)
+			}
+			continue
+		}
+		var e MalformedError
+		if !errors.As(err, &e) {
+			t.Errorf("depth %d: expected MalformedError, got %v", d.Depth, err)
+		}
+	}
+
+	objects := strings.Repeat(`{"a":`, DefaultMaxDepth*10) + "null" + strings.Repeat("}", DefaultMaxDepth*10)
+	tests := map[string]func(string) error{
+		"execute": func(str string) error {
+			_, err := Execute(strings.NewReader(str), `..a`)
+			return err
+		},
+		"decode": func(str string) error {
+			_, err := Decode(strings.NewReader(str), `.`)
+			return err
+		},
+		"validate": func(str string) error {
+			return Validate(strings.NewReader(str))
+		},
+		"format": func(str string) error {
+			return Format(strings.NewReader(str), io.Discard, "  ")
+		},
+	}
+	for name, fn := range tests {
+		var e MalformedError
+		if err := fn(objects); !errors.As(err, &e) {
+			t.Errorf("%s: expected MalformedError, got %v", name, err)
+		}
+	}
+}
+
+func TestMinify(t *testing.T) {
+	input := `{
+  "user": "foo  bar",
+  "smiley": "\ud83d\ude00 \" ",
+  "scores": [ 1, -2.5e3,	true, null ],
+  "meta": { }
+}
+`
+	want := `{"user":"foo  bar","smiley":"\ud83d\ude00 \" ","scores":[1,-2.5e3,true,null],"meta":{}}`
+	var buf bytes.Buffer
+	if err := Minify(strings.NewReader(input), &buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+	buf.Reset()
+	err := Minify(strings.NewReader(`{"user": "foo" "age": 42}`), &buf)
+	var e MalformedError
+	if !errors.As(err, &e) {
+		t.Errorf("expected MalformedError, got %v", err)
+	}
+}
+
+func TestRejectDuplicateKeys(t *testing.T) {
+	data := []struct {
+		Input string
+		Valid bool
+	}{
+		{Input: `{"a": 1, "b": {"a": 2}}`, Valid: true},
+		{Input: `[{"a": 1}, {"a": 2}]`, Valid: true},
+		{Input: `{"a": 1, "a": 2}`, Valid: false},
+		{Input: `{"a": {"b": 1, "c": 2, "b": 3}}`, Valid: false},
+	}
+	for _, d := range data {
+		_, err := Execute(strings.NewReader(d.Input), `.a`, RejectDuplicateKeys(true))
+		if d.Valid {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", d.Input, err)
+			}
+			continue
+		}
+		var e MalformedError
+		if !errors.As(err, &e) {
+			t.Errorf("%s: expected MalformedError, got %v", d.Input, err)
+			continue
+		}
+		if !strings.Contains(e.Message, "duplicate key") {
+			t.Errorf("%s: unexpected error message: %s", d.Input, e.Message)
+		}
+		if _, err := Execute(strings.NewReader(d.Input), `.a`); err != nil {
+			t.Errorf("%s: unexpected error without option: %s", d.Input, err)
+		}
+	}
+}
+
+func TestLongString(t *testing.T) {
+	str := strings.Repeat("aé€😀", 1000)
+	input := `{"text":"` + str + `"}`
+
+	got, err := Execute(strings.NewReader(input), `.text`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := `"` + str + `"`; got != want {
+		t.Errorf("result mismatched! want %d bytes, got %d bytes", len(want), len(got))
+	}
+
+	var buf bytes.Buffer
+	if err := Minify(strings.NewReader(input), &buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := buf.String(); got != input {
+		t.Errorf("result mismatched! want %d bytes, got %d bytes", len(input), len(got))
+	}
+}
+
+func TestFormat(t *testing.T) {
+	input := `{"user":"foo\tbar","age":42,"active":true,"parent":null,"scores":[0.5,-1e3],"meta":{},"tags":[],"nested":[{"id":1},[2,[3]]]}`
+	want := `{
+  "user": "foo\tbar",
+  "age": 42,
+  "active": true,
+  "parent": null,
+  "scores": [
+    0.5,
+    -1e3
+  ],
+  "meta": {},
+  "tags": [],
+  "nested": [
+    {
+      "id": 1
+    },
+    [
+      2,
+      [
+        3
+      ]
+    ]
+  ]
+}
+`
+	var buf bytes.Buffer
+	if err := Format(strings.NewReader(input), &buf, "  "); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+	var again bytes.Buffer
+	if err := Format(strings.NewReader(buf.String()), &again, "  "); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if again.String() != buf.String() {
+		t.Errorf("formatting not idempotent! want %s, got %s", buf.String(), again.String())
+	}
+	for _, str := range []string{`"foo"`, `42`, `null`} {
+		buf.Reset()
+		if err := Format(strings.NewReader(str), &buf, "\t"); err != nil {
+			t.Errorf("%s: unexpected error: %s", str, err)
+			continue
+		}
+		if got := buf.String(); got != str+"\n" {
+			t.Errorf("%s: result mismatched! got %s", str, got)
+		}
+	}
+	if err := Format(strings.NewReader(`{"a": [1,}`), &buf, "  "); err == nil {
+		t.Errorf("malformed document: expected error but got none")
+	}
+}
+
+func TestEngine(t *testing.T) {
+	input := `{"user": "foobar", "score": +42}`
+	e := Engine{
+		Newline:   true,
+		Lenient:   true,
+		KeepNulls: true,
+	}
+	got, err := e.Run(strings.NewReader(input), `{name: .user, .score, .age}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "{\"name\": \"foobar\", \"score\": 42, \"age\": null}\n"; got != want {
+		t.Errorf("result mismatched! want %q, got %q", want, got)
+	}
+
+	var zero Engine
+	if _, err := zero.Run(strings.NewReader(input), `.score`); err == nil {
+		t.Errorf("zero engine: expected error for leading '+' but got none")
+	}
+	got, err = zero.Run(strings.NewReader(`{"user": "foobar"}`), `.user`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := `"foobar"`; got != want {
+		t.Errorf("result mismatched! want %q, got %q", want, got)
+	}
+
+	q, err := e.Compile(`{.age}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if o, ok := q.(*object); !ok || !o.nulls {
+		t.Errorf("compiled query does not keep nulls")
+	}
+
+	indent := NewEngine(Indent("  "), LenientNumbers(true))
+	got, err = indent.Run(strings.NewReader(`{"user": "foobar", "scores": [+1, 2]}`), `{name: .user, .scores}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "{\n  \"name\": \"foobar\",\n  \"scores\": [\n    1,\n    2\n  ]\n}"; got != want {
+		t.Errorf("result mismatched! want %q, got %q", want, got)
+	}
+
+	compact := NewEngine(Compact(true), LenientNumbers(true))
+	got, err = compact.Run(strings.NewReader(`{"user": "foobar", "scores": [+1, 2]}`), `{name: .user, .scores}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := `{"name":"foobar","scores":[1,2]}`; got != want {
+		t.Errorf("result mismatched! want %q, got %q", want, got)
+	}
+
+	raw := NewEngine(RawStrings(true), TrailingNewline(true))
+	for query, want := range map[string]string{
+		`.user`:   "foo\tbar\n",
+		`.scores`: "[1, 2]\n",
+	} {
+		got, err = raw.Run(strings.NewReader(`{"user": "foo\tbar", "scores": [1, 2]}`), query)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", query, err)
+		}
+		if got != want {
+			t.Errorf("%s: result mismatched! want %q, got %q", query, want, got)
+		}
+	}
+}
+
+func TestKeepNulls(t *testing.T) {
+	data := []struct {
+		Input string
+		Query string
+		Want  string
+		Omit  string
+	}{
+		{
+			Input: `{"name": "foo", "age": 42}`,
+			Query: `{name: .name, age: .age}`,
+			Want:  `{"name": "foo", "age": 42}`,
+			Omit:  `{"name": "foo", "age": 42}`,
+		},
+		{
+			Input: `{"name": null, "age": 42}`,
+			Query: `{name: .name, age: .age}`,
+			Want:  `{"name": null, "age": 42}`,
+			Omit:  `{"name": null, "age": 42}`,
+		},
+		{
+			Input: `{"age": 42}`,
+			Query: `{name: .name, age: .age}`,
+			Want:  `{"age": 42, "name": null}`,
+			Omit:  `{"age": 42}`,
+		},
+		{
+			Input: `{"id": 1}`,
+			Query: `{name: .name, age: .age}`,
+			Want:  `{"age": null, "name": null}`,
+			Omit:  ``,
+		},
+		{
+			Input: `[{"name": "foo"}, {"age": 42}]`,
+			Query: `.[] | {name: .name}`,
+			Want:  `[{"name": "foo"}, {"name": null}]`,
+			Omit:  `{"name": "foo"}`,
+		},
+	}
+	for _, d := range data {
+		got, err := Execute(strings.NewReader(d.Input), d.Query, KeepNulls(true))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Input, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%s: result mismatched! want %s, got %s", d.Input, d.Want, got)
+		}
+		got, err = Execute(strings.NewReader(d.Input), d.Query)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Input, err)
+			continue
+		}
+		if got != d.Omit {
+			t.Errorf("%s: result mismatched (default)! want %s, got %s", d.Input, d.Omit, got)
+		}
+	}
+}
+
+func TestExecuteContext(t *testing.T) {
+	var str strings.Builder
+	str.WriteRune('[')
+	for i := 0; i < 10000; i++ {
+		if i > 0 {
+			str.WriteRune(',')
+		}
+		str.WriteString(`{"user": "foobar"}`)
+	}
+	str.WriteRune(']')
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := ExecuteContext(ctx, strings.NewReader(str.String()), `.[].user`)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled error, got %v", err)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	input := `{"user": "foo\nbar", "age": 42, "active": true, "parent": null, "scores": [0.5, 10], "meta": {}}`
+	got, err := Decode(strings.NewReader(input), `.`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := map[string]interface{}{
+		"user":   "foo\nbar",
+		"age":    int64(42),
+		"active": true,
+		"parent": nil,
+		"scores": []interface{}{0.5, int64(10)},
+		"meta":   map[string]interface{}{},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("result mismatched! want %v, got %v", want, got)
+	}
+
+	got, err = Decode(strings.NewReader(input), `.scores[]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := []interface{}{0.5, int64(10)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("result mismatched! want %v, got %v", want, got)
+	}
+
+	queries := []struct {
+		Query string
+		Want  interface{}
+	}{
+		{Query: `.user`, Want: "foo\nbar"},
+		{Query: `.scores[1]`, Want: int64(10)},
+		{Query: `.meta`, Want: map[string]interface{}{}},
+		{Query: `.missing`, Want: nil},
+		{Query: `.missing | sort`, Want: nil},
+		{Query: `{name: .user, n: .age}`, Want: map[string]interface{}{"name": "foo\nbar", "n": int64(42)}},
+		{Query: `.scores | sort`, Want: []interface{}{0.5, int64(10)}},
+	}
+	for _, q := range queries {
+		got, err := Decode(strings.NewReader(input), q.Query)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", q.Query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, q.Want) {
+			t.Errorf("%s: result mismatched! want %v, got %v", q.Query, q.Want, got)
+		}
+	}
+}
+
+func TestDecodeEscapes(t *testing.T) {
+	input := "{\"a\": \"x\ty\", \"b\": \"\\u00e9\\n\\\"\\ud83d\\ude00\", \"k\\u00e9\": 1}"
+	if _, err := Execute(strings.NewReader(input), `.a`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	data := []struct {
+		Query string
+		Want  interface{}
+	}{
+		{Query: `.a`, Want: "x\ty"},
+		{Query: `.b`, Want: "é\n\"😀"},
+		{Query: `{v: .a}`, Want: map[string]interface{}{"v": "x\ty"}},
+		{Query: `.`, Want: map[string]interface{}{"a": "x\ty", "b": "é\n\"😀", "ké": int64(1)}},
+	}
+	for _, d := range data {
+		got, err := Decode(strings.NewReader(input), d.Query)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, d.Want) {
+			t.Errorf("%s: result mismatched! want %q, got %q", d.Query, d.Want, got)
+		}
+	}
+}
+
+func TestDecodeMultiDocument(t *testing.T) {
+	data := []struct {
+		Query string
+		Want  interface{}
+	}{
+		{Query: `.a`, Want: []interface{}{int64(1), "x"}},
+		{Query: `.`, Want: []interface{}{map[string]interface{}{"a": int64(1)}, map[string]interface{}{"b": true}, map[string]interface{}{"a": "x"}}},
+		{Query: `{v: .a}`, Want: []interface{}{map[string]interface{}{"v": int64(1)}, map[string]interface{}{"v": "x"}}},
+	}
+	input := `{"a": 1} {"b": true} {"a": "x"}`
+	for _, d := range data {
+		got, err := Decode(strings.NewReader(input), d.Query, MultiDocument(true))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, d.Want) {
+			t.Errorf("%s: result mismatched! want %v, got %v", d.Query, d.Want, got)
+		}
+	}
+	if _, err := Decode(strings.NewReader(`{"a": 1} {"a": `), `.a`, MultiDocument(true)); err == nil {
+		t.Errorf("expected error for malformed second document")
+	}
+	if _, err := Decode(strings.NewReader(input), `.a`); err == nil {
+		t.Errorf("expected error without MultiDocument")
+	}
+}
+
+func TestDecodeInteger(t *testing.T) {
+	input := `{"id": 9007199254740993, "min": -9223372036854775808, "big": 92233720368547758070, "ratio": 0.5, "exp": 1e3}`
+	got, err := Decode(strings.NewReader(input), `.`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := map[string]interface{}{
+		"id":    int64(9007199254740993),
+		"min":   int64(-9223372036854775808),
+		"big":   float64(92233720368547758070),
+		"ratio": 0.5,
+		"exp":   float64(1000),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("result mismatched! want %v, got %v", want, got)
+	}
+}
+
+func TestDecodeUseNumber(t *testing.T) {
+	input := `{"id": 10000000000000001, "ratio": 0.1, "exp": 1E400}`
+	got, err := Execute(strings.NewReader(input), `.id`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "10000000000000001"; got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+	value, err := Decode(strings.NewReader(input), `.`, UseNumber(true))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := map[string]interface{}{
+		"id":    json.Number("10000000000000001"),
+		"ratio": json.Number("0.1"),
+		"exp":   json.Number("1E400"),
+	}
+	if !reflect.DeepEqual(value, want) {
+		t.Errorf("result mismatched! want %v, got %v", want, value)
+	}
+	id, err := value.(map[string]interface{})["id"].(json.Number).Int64()
+	if err != nil || id != 10000000000000001 {
+		t.Errorf("id mismatched! want 10000000000000001, got %d (%v)", id, err)
+	}
+}
+
+func TestSniffJSON(t *testing.T) {
+	data := []struct {
+		Input string
+		Want  bool
+	}{
+		{Input: `{"user": "foobar"}`, Want: true},
+		{Input: "\n\t [1, 2]", Want: true},
+		{Input: `"foobar"`, Want: true},
+		{Input: "user,age\nfoobar,42", Want: false},
+		{Input: `42`, Want: false},
+		{Input: "  ", Want: false},
+		{Input: "", Want: false},
+	}
+	for _, d := range data {
+		r, ok, err := SniffJSON(strings.NewReader(d.Input))
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Input, err)
+			continue
+		}
+		if ok != d.Want {
+			t.Errorf("%q: sniffing mismatched! want %t, got %t", d.Input, d.Want, ok)
+		}
+		got, _ := io.ReadAll(r)
+		if string(got) != d.Input {
+			t.Errorf("%q: input not preserved, got %q", d.Input, got)
+		}
+	}
+}
+
+func TestFromJSON_Error(t *testing.T) {
+	input := `{"payload": "{\"user\": [1, }"}`
+	_, err := Execute(strings.NewReader(input), `.payload | fromjson`)
+	var malformed MalformedError
+	if !errors.As(err, &malformed) {
+		t.Fatalf("expected malformed error, got %v", err)
+	}
+	if want := (Position{Line: 1, Col: 14}); malformed.Position != want {
+		t.Errorf("position mismatched! want %s, got %s", want, malformed.Position)
+	}
+}
+
+func TestStream(t *testing.T) {
+	input := `{"items": [{"id": 1, "name": "foo"}, {"id": 2, "name": "bar"}]}`
+	data := []struct {
+		Input string
+		Query string
+		Want  string
+		Opts  []Option
+	}{
+		{
+			Input: input,
+			Query: `.items[].id`,
+			Want:  "1\n2\n",
+		},
+		{
+			Input: input,
+			Query: `.items[] | .name`,
+			Want:  "\"foo\"\n\"bar\"\n",
+		},
+		{
+			Input: input,
+			Query: `{first: .items[0].name}`,
+			Want:  "{\"first\": \"foo\"}\n",
+		},
+		{
+			Input: `{"id": 1} {"id": 2} {"name": "foo"} {"id": 3}`,
+			Query: `.id`,
+			Want:  "1\n2\n3\n",
+			Opts:  []Option{MultiDocument(true)},
+		},
+		{
+			Input: input,
+			Query: `.missing`,
+		},
+	}
+	for _, d := range data {
+		var buf bytes.Buffer
+		if err := Stream(&buf, strings.NewReader(d.Input), d.Query, d.Opts...); err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if got := buf.String(); got != d.Want {
+			t.Errorf("%s: result mismatched! want %q, got %q", d.Query, d.Want, got)
+		}
+	}
+	var buf bytes.Buffer
+	if err := Stream(&buf, strings.NewReader(`[1, 2, }`), `.[]`); err == nil {
+		t.Errorf("expected error for malformed document")
+	}
+}
+
+func TestRelaxed(t *testing.T) {
+	data := []struct {
+		Input string
+		Query string
+		Want  string
+	}{
+		{
+			Input: "// settings\n{\n  /* user */ \"user\": \"foo\", // name\n  \"age\": 42\n}",
+			Query: `.`,
+			Want:  `{"user": "foo", "age": 42}`,
+		},
+		{
+			Input: `[1, /* two */ 2, // three
+			3]`,
+			Query: `.`,
+			Want:  `[1, 2, 3]`,
+		},
+		{
+			Input: `{"list": [1, 2,], "user": {"name": "foo",},}`,
+			Query: `.`,
+			Want:  `{"list": [1, 2], "user": {"name": "foo"}}`,
+		},
+		{
+			Input: `{"list": [1, 2, /* end */ ], "user": {"name": "foo", // end
+			}}`,
+			Query: `.user.name`,
+			Want:  `"foo"`,
+		},
+		{
+			Input: `{"url": "http://example.org/*", "sep": ",]"}`,
+			Query: `.`,
+			Want:  `{"url": "http://example.org/*", "sep": ",]"}`,
+		},
+	}
+	for _, d := range data {
+		got, err := Execute(strings.NewReader(d.Input), d.Query, RelaxedSyntax(true))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Input, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%s: result mismatched! want %s, got %s", d.Input, d.Want, got)
+		}
+	}
+	for _, d := range data[:4] {
+		if _, err := Execute(strings.NewReader(d.Input), d.Query); err == nil {
+			t.Errorf("%s: relaxed document accepted without option", d.Input)
+		}
+	}
+	for _, str := range []string{`[1, 2,,]`, `[,]`, `{"a": 1 / 2}`, `/* é */ [1, 2 x]`} {
+		_, err := Execute(strings.NewReader(str), `.`, RelaxedSyntax(true))
+		if err == nil {
+			t.Errorf("%s: invalid document accepted", str)
+		}
+	}
+	var malformed MalformedError
+	_, err := Execute(strings.NewReader("/* é */ [1, 2 x]"), `.`, RelaxedSyntax(true))
+	if !errors.As(err, &malformed) {
+		t.Fatalf("expected malformed error, got %v", err)
+	}
+	if want := (Position{Line: 1, Col: 15}); malformed.Position != want {
+		t.Errorf("position mismatched! want %s, got %s", want, malformed.Position)
+	}
+
+	for _, str := range []string{`{"a": 1} /* unterminated`, "{\"a\": 1,\n /* x */ /*", `[1, /* x`} {
+		_, err := Execute(strings.NewReader(str), `.a`, RelaxedSyntax(true))
+		if !errors.As(err, &malformed) {
+			t.Errorf("%q: expected malformed error, got %v", str, err)
+		}
+		if err := Validate(strings.NewReader(str), RelaxedSyntax(true)); !errors.As(err, &malformed) {
+			t.Errorf("%q: expected malformed error, got %v", str, err)
+		}
+	}
+	_, err = Execute(strings.NewReader(`{"a": 1} /* unterminated`), `.a`, RelaxedSyntax(true))
+	if errors.As(err, &malformed) && malformed.Position != (Position{Line: 1, Col: 10}) {
+		t.Errorf("position mismatched! want 1:10, got %s", malformed.Position)
+	}
+	got, err := Execute(strings.NewReader(`{"a": 1} // line comment`), `.a`, RelaxedSyntax(true))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != "1" {
+		t.Errorf("result mismatched! want 1, got %s", got)
+	}
+}
+
+func TestStrictTypes(t *testing.T) {
+	input := `{"tags": ["a", "b"], "user": {"name": "foo"}, "items": [{"id": 1}, 2], "age": 42, "parent": null}`
+	valid := []struct {
+		Query string
+		Want  string
+	}{
+		{Query: `.tags`, Want: `["a", "b"]`},
+		{Query: `.tags[1]`, Want: `"b"`},
+		{Query: `.user["name"]`, Want: `"foo"`},
+		{Query: `.user[]`, Want: `"foo"`},
+		{Query: `.items[0].id`, Want: `1`},
+		{Query: `..id`, Want: `1`},
+		{Query: `.tags | .[1]`, Want: `"b"`},
+		{Query: `.user | .name`, Want: `"foo"`},
+		{Query: `.tags | sort | .[0]`, Want: `"a"`},
+	}
+	for _, d := range valid {
+		got, err := Execute(strings.NewReader(input), d.Query, StrictTypes(true))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%s: result mismatched! want %s, got %s", d.Query, d.Want, got)
+		}
+	}
+	invalid := []string{
+		`.tags.first`,
+		`.tags["first"]`,
+		`.user[0]`,
+		`.user.name.first`,
+		`.items[].id`,
+		`.age[0]`,
+		`.parent.name`,
+		`.tags | .first`,
+		`.user | .[0]`,
+		`.age | .x`,
+		`.user | .name | .first`,
+		`[.tags | .first]`,
+		`.items | sort_by(.id)`,
+	}
+	for _, q := range invalid {
+		if _, err := Execute(strings.NewReader(input), q); err != nil {
+			t.Errorf("%s: unexpected error without strict types: %s", q, err)
+		}
+		_, err := Execute(strings.NewReader(input), q, StrictTypes(true))
+		if !isMalformed(err) {
+			t.Errorf("%s: expected malformed error, got %v", q, err)
+		}
+	}
+}
+
+func TestEdgeTypes(t *testing.T) {
+	input := `{"user": {"name": "foo"}, "age": 42, "tags": ["a", "b"]}`
+	for _, q := range []string{`first`, `.user | first`, `.age | last`, `.user.name | first`, `.tags[] | last`} {
+		for _, strict := range []bool{false, true} {
+			_, err := Execute(strings.NewReader(input), q, StrictTypes(strict))
+			if !isMalformed(err) {
+				t.Errorf("%s (strict: %t): expected malformed error, got %v", q, strict, err)
+			}
+		}
+	}
+	got, err := Execute(strings.NewReader(input), `.tags | first`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := `"a"`; got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+}
+
+func TestMissingPath(t *testing.T) {
+	data := []struct {
+		Input string
+		Query string
+	}{
+		{Input: `{"user": null}`, Query: `.user.name`},
+		{Input: `{"user": null}`, Query: `.user[0].name`},
+		{Input: `{"user": 42}`, Query: `.user.name`},
+		{Input: `{"user": [{"id": 1}]}`, Query: `.user.name`},
+		{Input: `{"user": {"id": 1}}`, Query: `.user[0]`},
+		{Input: `[null, {"name": "foo"}]`, Query: `.[1].name.first`},
+	}
+	for _, d := range data {
+		var count int
+		err := Each(strings.NewReader(d.Input), d.Query, func(interface{}) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if count != 0 {
+			t.Errorf("%s: expected no value, got %d", d.Query, count)
+		}
+	}
+	for _, str := range []string{`{"user": null`, `{"user": nul}`, `{"user": [null}`} {
+		err := Each(strings.NewReader(str), `.user.name`, func(interface{}) error {
+			return nil
+		})
+		if err == nil {
+			t.Errorf("%s: expected error for malformed document", str)
+		}
+	}
+}
+
+func TestBOM(t *testing.T) {
+	input := "\ufeff{\"user\": \"foo\", \"tags\": [\"a\", \"b\"]}"
+	data := []struct {
+		Query string
+		Want  string
+	}{
+		{Query: `.`, Want: `{"user": "foo", "tags": ["a", "b"]}`},
+		{Query: `.tags[1]`, Want: `"b"`},
+	}
+	for _, d := range data {
+		got, err := Execute(strings.NewReader(input), d.Query)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%s: result mismatched! want %s, got %s", d.Query, d.Want, got)
+		}
+	}
+	if err := Validate(strings.NewReader(input)); err != nil {
+		t.Errorf("unexpected error validating document: %s", err)
+	}
+	if _, ok, err := SniffJSON(strings.NewReader(input)); err != nil || !ok {
+		t.Errorf("document with BOM not detected as JSON (%v)", err)
+	}
+	_, err := Execute(strings.NewReader("{} \ufeff{}"), `.`, MultiDocument(true))
+	if !isMalformed(err) {
+		t.Errorf("expected malformed error for BOM after the first document, got %v", err)
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	input := `{"user": "` + strings.Repeat("foo bar ", 100) + `", "scores": [1, 2, 3]}`
+	for _, size := range []int{0, 16, 64, 1 << 16} {
+		got, err := Execute(strings.NewReader(input), `.scores`, BufferSize(size))
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", size, err)
+			continue
+		}
+		if want := `[1, 2, 3]`; got != want {
+			t.Errorf("%d: result mismatched! want %s, got %s", size, want, got)
+		}
+	}
+}
+
+type countReader struct {
+	io.Reader
+	count int
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	c.count++
+	return c.Reader.Read(b)
+}
+
+func BenchmarkExecute(b *testing.B) {
+	var (
+		deep = deepDocument(500)
+		wide = wideDocument(10000)
+	)
+	data := []struct {
+		Name  string
+		Input string
+		Query string
+	}{
+		{Name: "deep/all", Input: deep, Query: `.`},
+		{Name: "deep/path", Input: deep, Query: `.child.child.child.child.child.id`},
+		{Name: "deep/recurse", Input: deep, Query: `..id`},
+		{Name: "wide/all", Input: wide, Query: `.`},
+		{Name: "wide/path", Input: wide, Query: `.[].name`},
+		{Name: "wide/index", Input: wide, Query: `.[100, 5000, 9999].id`},
+		{Name: "wide/first", Input: wide, Query: `first | .id`},
+		{Name: "wide/last", Input: wide, Query: `last | .id`},
+		{Name: "wide/recurse", Input: wide, Query: `..tags`},
+		{Name: "wide/pipeline", Input: wide, Query: `.[] | {id: .id, first: .tags[0]}`},
+	}
+	for _, d := range data {
+		b.Run(d.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(d.Input)))
+			for i := 0; i < b.N; i++ {
+				if _, err := Execute(strings.NewReader(d.Input), d.Query); err != nil {
+					b.Fatalf("unexpected error: %s", err)
+				}
+			}
+		})
+	}
+}
+
+// wideDocument generates an array of n objects with the same fields.
+func wideDocument(n int) string {
+	var str strings.Builder
+	str.WriteRune('[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			str.WriteString(", ")
+		}
+		str.WriteString(`{"id": `)
+		str.WriteString(strconv.Itoa(i))
+		str.WriteString(`, "name": "foobar", "tags": ["a", "b"]}`)
+	}
+	str.WriteRune(']')
+	return str.String()
+}
+
+// deepDocument generates depth objects nested in each other via their child
+// field.
+func deepDocument(depth int) string {
+	var str strings.Builder
+	for i := 0; i < depth; i++ {
+		str.WriteString(`{"id": `)
+		str.WriteString(strconv.Itoa(i))
+		str.WriteString(`, "name": "foobar", "child": `)
+	}
+	str.WriteString("null")
+	str.WriteString(strings.Repeat("}", depth))
+	return str.String()
+}
+
+func BenchmarkBufferSize(b *testing.B) {
+	input := wideDocument(10000)
+
+	for _, size := range []int{DefaultBufferSize, 1 << 16, 1 << 20} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			var reads int
+			for i := 0; i < b.N; i++ {
+				rs := countReader{
+					Reader: strings.NewReader(input),
+				}
+				if _, err := Execute(&rs, `.[].name`, BufferSize(size)); err != nil {
+					b.Fatalf("unexpected error: %s", err)
+				}
+				reads += rs.count
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func BenchmarkConstruct(b *testing.B) {
+	input := wideDocument(100000)
+
+	queries := []string{
+		`[.[].id, .[].name]`,
+		`.[] | {id: .id, first: .tags[0]}`,
+	}
+	for _, q := range queries {
+		b.Run(q, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Execute(strings.NewReader(input), q); err != nil {
+					b.Fatalf("unexpected error: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func TestExecuteQuery(t *testing.T) {
+	input := `{"items": [{"id": 1, "name": "foo", "tags": ["a", "b"]}, {"id": 2, "name": "bar"}]}`
+	q, err := Q().Field("items").Index(0).Pipe(Obj().
+		Set("id", Q().Field("id")).
+		Set("tags", Arr(Q().Field("tags").Iterate())),
+	).Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `{"id": 1, "tags": ["a", "b"]}`
+	for i := 0; i < 2; i++ {
+		got, err := ExecuteQuery(strings.NewReader(input), q)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != want {
+			t.Errorf("result mismatched! want %s, got %s", want, got)
+		}
+	}
+}
+
+func TestEach(t *testing.T) {
+	input := `{"items": [{"id": 1, "name": "foo"}, {"id": 2, "name": "bar"}, {"id": 3, "name": "baz"}]}`
+	data := []struct {
+		Query string
+		Want  []interface{}
+	}{
+		{
+			Query: `.items[].id`,
+			Want:  []interface{}{int64(1), int64(2), int64(3)},
+		},
+		{
+			Query: `.items[] | .name`,
+			Want:  []interface{}{"foo", "bar", "baz"},
+		},
+		{
+			Query: `.items[0]`,
+			Want:  []interface{}{map[string]interface{}{"id": int64(1), "name": "foo"}},
+		},
+		{
+			Query: `[.items[].id]`,
+			Want:  []interface{}{[]interface{}{int64(1), int64(2), int64(3)}},
+		},
+	}
+	for _, d := range data {
+		var got []interface{}
+		err := Each(strings.NewReader(input), d.Query, func(v interface{}) error {
+			got = append(got, v)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, d.Want) {
+			t.Errorf("%s: result mismatched! want %v, got %v", d.Query, d.Want, got)
+		}
+	}
+
+	var (
+		count int
+		stop  = errors.New("stop")
+	)
+	err := Each(strings.NewReader(input), `.items[].id`, func(v interface{}) error {
+		count++
+		if count == 2 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("expected error returned by callback, got %v", err)
+	}
+	if count != 2 {
+		t.Errorf("callback called %d times after error", count)
+	}
+}
+
+func TestAutoDecompress(t *testing.T) {
+	input := `{"user": "foobar", "age": 42}`
+
+	var buf bytes.Buffer
+	z := gzip.NewWriter(&buf)
+	z.Write([]byte(input))
+	z.Close()
+
+	for _, r := range []io.Reader{&buf, strings.NewReader(input), strings.NewReader("")} {
+		rs, err := AutoDecompress(r)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			continue
+		}
+		got, err := io.ReadAll(rs)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			continue
+		}
+		if len(got) > 0 && string(got) != input {
+			t.Errorf("result mismatched! want %s, got %s", input, got)
+		}
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "*.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer f.Close()
+	f.WriteString(input)
+	f.Seek(0, io.SeekStart)
+
+	rs, err := AutoDecompress(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n, ok := rs.(interface{ Name() string }); !ok || n.Name() != f.Name() {
+		t.Errorf("file name not forwarded")
+	}
+	got, err := Execute(rs, `.user`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := `"foobar"`; got != want {
+		t.Errorf("result mismatched! want %s, got %s", want, got)
+	}
+}
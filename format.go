@@ -0,0 +1,178 @@
+package query
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Format reads the JSON document from r and writes it in w with each element of
+// arrays and objects on its own line, indented with indent for each level of
+// nesting.
+func Format(r io.Reader, w io.Writer, indent string) error {
+	p := printer{
+		Writer: bufio.NewWriter(w),
+		indent: indent,
+	}
+	if err := p.print(r); err != nil {
+		return err
+	}
+	p.WriteRune('\n')
+	return p.Flush()
+}
+
+// Minify reads the JSON document from r and writes it in w without any
+// insignificant blank. Strings are written as they are in r.
+func Minify(r io.Reader, w io.Writer) error {
+	p := printer{
+		Writer:  bufio.NewWriter(w),
+		compact: true,
+	}
+	if err := p.print(r); err != nil {
+		return err
+	}
+	return p.Flush()
+}
+
+type printer struct {
+	*bufio.Writer
+	indent  string
+	compact bool
+}
+
+func (p printer) print(r io.Reader) error {
+	rs := prepare(r)
+	rs.keepEscapes = true
+	if err := rs.format(p, 0); err != nil {
+		return err
+	}
+	return rs.end()
+}
+
+func (p printer) newline(level int) {
+	if p.compact {
+		return
+	}
+	p.WriteRune('\n')
+	p.WriteString(strings.Repeat(p.indent, level))
+}
+
+func (p printer) colon() {
+	p.WriteRune(':')
+	if !p.compact {
+		p.WriteRune(' ')
+	}
+}
+
+func (r *reader) format(w printer, level int) error {
+	c, err := r.read()
+	if err != nil {
+		return err
+	}
+	switch {
+	case jsonQuote(c):
+		str, err := r.literal()
+		if err != nil {
+			return err
+		}
+		w.WriteRune('"')
+		w.WriteString(str)
+		w.WriteRune('"')
+	case jsonIdent(c):
+		v, err := r.identifier()
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			w.WriteString("null")
+		} else {
+			fmt.Fprint(w, v)
+		}
+	case jsonNumber(c):
+		str, err := r.number()
+		if err != nil {
+			return err
+		}
+		w.WriteString(str)
+	case jsonArray(c):
+		return r.formatArray(w, level)
+	case jsonObject(c):
+		return r.formatObject(w, level)
+	default:
+		return r.malformed("unexpected character %c", c)
+	}
+	return nil
+}
+
+func (r *reader) formatObject(w printer, level int) error {
+	if err := r.enter(); err != nil {
+		return err
+	}
+	defer r.leave()
+
+	w.WriteRune('{')
+	if c, _ := r.read(); c == '}' {
+		w.WriteRune('}')
+		return nil
+	}
+	r.unread()
+	seen := r.keys()
+	for {
+		key, err := r.key()
+		if err != nil {
+			return err
+		}
+		if err := r.unique(seen, key); err != nil {
+			return err
+		}
+		w.newline(level + 1)
+		w.WriteRune('"')
+		w.WriteString(key)
+		w.WriteRune('"')
+		w.colon()
+		if err := r.format(w, level+1); err != nil {
+			return err
+		}
+		if err := r.endObject(); err != nil {
+			if isDone(err) {
+				break
+			}
+			return err
+		}
+		w.WriteRune(',')
+	}
+	w.newline(level)
+	w.WriteRune('}')
+	return nil
+}
+
+func (r *reader) formatArray(w printer, level int) error {
+	if err := r.enter(); err != nil {
+		return err
+	}
+	defer r.leave()
+
+	w.WriteRune('[')
+	if c, _ := r.read(); c == ']' {
+		w.WriteRune(']')
+		return nil
+	}
+	r.unread()
+	for {
+		w.newline(level + 1)
+		if err := r.format(w, level+1); err != nil {
+			return err
+		}
+		if err := r.endArray(); err != nil {
+			if isDone(err) {
+				break
+			}
+			return err
+		}
+		w.WriteRune(',')
+	}
+	w.newline(level)
+	w.WriteRune(']')
+	return nil
+}
@@ -0,0 +1,136 @@
+package query
+
+// Optimize gives a query equivalent to q that is simpler to execute. Identity
+// stages are removed from pipelines, stages selecting keys or indexes are
+// appended to the path of the stage before them when possible and any with a
+// single query is replaced by this query. Pipelines with links are left as
+// they are since links refer to the stages by their position. q is not
+// modified.
+func Optimize(q Query) Query {
+	switch q := q.(type) {
+	case *pipeline:
+		return optimizePipeline(q)
+	case *any:
+		if len(q.list) == 1 {
+			return Optimize(q.list[0])
+		}
+		return Any(optimizeList(q.list)...)
+	case *array:
+		return Array(optimizeList(q.list)...)
+	case *object:
+		var (
+			keys []string
+			list []Query
+		)
+		for k, f := range q.fields {
+			keys = append(keys, k)
+			list = append(list, Optimize(f))
+		}
+		obj := Object(keys, list).(*object)
+		obj.nulls = q.nulls
+		return obj
+	case *ident:
+		return IdentNext(q.ident, optimizeNext(q.next))
+	case *index:
+		return IndexNext(q.list, optimizeNext(q.next))
+	case *recurse:
+		return Recurse(Optimize(q.Query))
+	default:
+		return q.Clone()
+	}
+}
+
+func optimizeNext(q Query) Query {
+	if q == nil {
+		return nil
+	}
+	return Optimize(q)
+}
+
+func optimizeList(list []Query) []Query {
+	var res []Query
+	for i := range list {
+		res = append(res, Optimize(list[i]))
+	}
+	return res
+}
+
+func optimizePipeline(p *pipeline) Query {
+	if hasLink(p) {
+		return p.Clone()
+	}
+	var list []Query
+	for _, q := range append([]Query{p.Query}, p.queries...) {
+		q = Optimize(q)
+		if _, ok := q.(*all); ok {
+			continue
+		}
+		if n := len(list); n > 0 && canMerge(list[n-1], q) {
+			list[n-1] = merge(list[n-1], q)
+			continue
+		}
+		list = append(list, q)
+	}
+	switch {
+	case len(list) == 0:
+		return All()
+	case len(list) == 1:
+		return list[0]
+	case isTransform(list[0]):
+		return PipeLine(All(), list...)
+	default:
+		return PipeLine(list[0], list[1:]...)
+	}
+}
+
+func hasLink(q Query) bool {
+	var found bool
+	Walk(q, func(q Query) bool {
+		if _, ok := q.(*ptr); ok {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+func canMerge(q, next Query) bool {
+	switch next.(type) {
+	case *ident, *index:
+	default:
+		return false
+	}
+	for {
+		switch x := q.(type) {
+		case *ident:
+			if x.next == nil {
+				return true
+			}
+			q = x.next
+		case *index:
+			if x.next == nil {
+				return true
+			}
+			q = x.next
+		default:
+			return false
+		}
+	}
+}
+
+func merge(q, next Query) Query {
+	switch x := q.(type) {
+	case *ident:
+		if x.next == nil {
+			return IdentNext(x.ident, next)
+		}
+		return IdentNext(x.ident, merge(x.next, next))
+	case *index:
+		if x.next == nil {
+			return IndexNext(x.list, next)
+		}
+		return IndexNext(x.list, merge(x.next, next))
+	default:
+		return q.Clone()
+	}
+}
@@ -5,8 +5,6 @@ import (
 	"strconv"
 	"strings"
 	"unicode/utf8"
-
-	"github.com/midbel/slices"
 )
 
 type Parser struct {
@@ -19,8 +17,7 @@ type Parser struct {
 }
 
 func Parse(str string) (Query, error) {
-	str = strings.TrimSpace(str)
-	if str == Identity {
+	if strings.TrimSpace(str) == Identity {
 		return All(), nil
 	}
 	p := Parser{
@@ -85,6 +82,12 @@ func (p *Parser) parseQuery() (Query, error) {
 		curr, err = p.parseObject()
 	case Link:
 		curr, err = p.parseLink()
+	case Func:
+		curr, err = p.parseFunc()
+	case Literal:
+		curr, err = p.parseKeyword()
+	case Lparen:
+		curr, err = p.parseGroup()
 	}
 	if p.is(Pipe) && err == nil {
 		curr, err = p.parsePipe(curr)
@@ -93,26 +96,132 @@ func (p *Parser) parseQuery() (Query, error) {
 		return nil, err
 	}
 	switch p.curr.Type {
-	case Eof, Comma, Pipe, Rsquare, Rcurly:
+	case Eof, Comma, Pipe, Rsquare, Rcurly, Rparen:
 	default:
-		return nil, p.parseError("query: expected ',', '|', '}', ']', ',' or end of input")
+		return nil, p.parseError("query: expected ',', '|', '}', ']', ')' or end of input")
 	}
 	return curr, err
 }
 
+func (p *Parser) parseGroup() (Query, error) {
+	p.next()
+	q, err := p.parseQuery()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(Rparen, "group: expected ')'"); err != nil {
+		return nil, err
+	}
+	p.next()
+	return q, nil
+}
+
 func (p *Parser) parseLink() (Query, error) {
+	link := p.curr
 	p.next()
-	var k ptr
+	var (
+		k ptr
+		n int
+	)
 	if p.is(Number) {
+		x, err := strconv.Atoi(p.curr.Literal)
+		if err != nil {
+			return nil, p.parseError("link: invalid index %s", p.curr.Literal)
+		}
+		n = x
 		p.next()
 	}
 	if len(p.parsed) == 0 {
-		return nil, p.parseError("no query parsed")
+		return nil, p.parseErrorAt(link, "no query parsed")
 	}
-	k.Query = slices.Fst(p.parsed)
+	if n < 0 || n >= len(p.parsed) {
+		return nil, p.parseErrorAt(link, "link: index %d out of range (%d queries parsed)", n, len(p.parsed))
+	}
+	k.Query = p.parsed[n].Clone()
+	k.index = n
 	return &k, nil
 }
 
+func (p *Parser) parseFunc() (Query, error) {
+	name := p.curr.Literal
+	fn, ok := formats[name]
+	if !ok {
+		return nil, p.parseError("@%s: format not defined", name)
+	}
+	p.next()
+	return Transform(name, fn), nil
+}
+
+func (p *Parser) parseKeyword() (Query, error) {
+	if _, ok := functions[p.curr.Literal]; ok {
+		return p.parseCall()
+	}
+	if _, ok := reducers[p.curr.Literal]; ok {
+		return p.parseReduce()
+	}
+	fn, ok := keywords[p.curr.Literal]
+	if !ok {
+		return nil, p.parseError("%s: filter not defined", p.curr.Literal)
+	}
+	p.next()
+	return fn(), nil
+}
+
+func (p *Parser) parseCall() (Query, error) {
+	tok := p.curr
+	p.next()
+	if err := p.expect(Lparen, tok.Literal+": expected '('"); err != nil {
+		return nil, err
+	}
+	p.next()
+	var args []string
+	for !p.is(Rparen) {
+		if !p.is(String) {
+			return nil, p.parseError("%s: expected string argument", tok.Literal)
+		}
+		arg, err := unquoteString(`"` + p.curr.Literal + `"`)
+		if err != nil {
+			return nil, p.parseError("%s: invalid string argument %s", tok.Literal, p.curr.Literal)
+		}
+		args = append(args, arg)
+		p.next()
+		switch p.curr.Type {
+		case Comma:
+			p.next()
+			if p.is(Rparen) {
+				return nil, p.parseError("%s: expected argument after ','", tok.Literal)
+			}
+		case Rparen:
+		default:
+			return nil, p.parseError("%s: expected ',' or ')'", tok.Literal)
+		}
+	}
+	p.next()
+	q, err := functions[tok.Literal](args)
+	if err != nil {
+		return nil, p.parseErrorAt(tok, "%s: %s", tok.Literal, err)
+	}
+	return q, nil
+}
+
+func (p *Parser) parseReduce() (Query, error) {
+	name := p.curr.Literal
+	p.next()
+	if err := p.expect(Lparen, name+": expected '('"); err != nil {
+		return nil, err
+	}
+	p.next()
+	q, err := p.parseQuery()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(Rparen, name+": expected ')'"); err != nil {
+		return nil, err
+	}
+	p.next()
+	return reducers[name](q), nil
+}
+
 func (p *Parser) parseDot() (Query, error) {
 	p.next()
 	var (
@@ -125,7 +234,7 @@ func (p *Parser) parseDot() (Query, error) {
 		curr, err = p.parseQuery()
 	case Eof:
 		curr = All()
-	case Literal:
+	case Literal, String:
 		curr, err = p.parseIdent()
 	case Lsquare:
 		curr, err = p.parseIndex()
@@ -168,11 +277,10 @@ func (p *Parser) parseIndex() (Query, error) {
 		err error
 	)
 	for !p.done() && !p.is(Rsquare) {
-		if err := p.expect(Number, "index: number expected"); err != nil {
-			return nil, err
+		if !p.is(Number) && !p.is(String) {
+			return nil, p.parseError("index: number or string expected")
 		}
-
-		if _, err := strconv.Atoi(p.curr.Literal); err != nil {
+		if _, err := strconv.Atoi(p.curr.Literal); p.is(Number) && err != nil {
 			return nil, err
 		}
 		idx.list = append(idx.list, p.curr.Literal)
@@ -181,7 +289,7 @@ func (p *Parser) parseIndex() (Query, error) {
 		case Comma:
 			p.next()
 			if p.is(Rsquare) {
-				return nil, p.parseError("index: expected number after ','")
+				return nil, p.parseError("index: expected number or string after ','")
 			}
 		case Rsquare:
 		default:
@@ -199,6 +307,8 @@ func (p *Parser) parseIndex() (Query, error) {
 	}
 	if p.is(Dot) || p.is(Depth) {
 		idx.next, err = p.parseQuery()
+	} else if p.is(Lsquare) {
+		idx.next, err = p.parseIndex()
 	} else if p.is(Pipe) {
 		return p.parsePipe(&idx)
 	}
@@ -214,8 +324,14 @@ func (p *Parser) parsePipe(q Query) (Query, error) {
 			return p.parseObject()
 		case Link:
 			return p.parseLink()
+		case Func:
+			return p.parseFunc()
+		case Literal:
+			return p.parseKeyword()
 		case Depth:
 			return p.parseQuery()
+		case Lparen:
+			return p.parseGroup()
 		default:
 			return p.parseDot()
 		}
@@ -224,7 +340,11 @@ func (p *Parser) parsePipe(q Query) (Query, error) {
 	pip := pipeline{
 		Query: q,
 	}
-	for !p.done() && !p.is(Rcurly) && !p.is(Rsquare) && !p.is(Comma) {
+	if isTransform(q) {
+		pip.Query = All()
+		pip.queries = append(pip.queries, q)
+	}
+	for !p.done() && !p.is(Rcurly) && !p.is(Rsquare) && !p.is(Rparen) && !p.is(Comma) {
 		q, err := parse()
 		if err != nil {
 			return nil, err
@@ -236,12 +356,12 @@ func (p *Parser) parsePipe(q Query) (Query, error) {
 		switch p.curr.Type {
 		case Pipe:
 			p.next()
-			if p.is(Eof) || p.is(Rcurly) || p.is(Rsquare) || p.is(Comma) {
+			if p.is(Eof) || p.is(Rcurly) || p.is(Rsquare) || p.is(Rparen) || p.is(Comma) {
 				return nil, p.parseError("pipeline: expected query after '|")
 			}
-		case Eof, Comma, Rcurly, Rsquare:
+		case Eof, Comma, Rcurly, Rsquare, Rparen:
 		default:
-			return nil, p.parseError("pipeline: expected '|', '}', ']' or ','")
+			return nil, p.parseError("pipeline: expected '|', '}', ']', ')' or ','")
 		}
 	}
 	return &pip, nil
@@ -258,7 +378,7 @@ func (p *Parser) parseArray() (Query, error) {
 			next Query
 			err  error
 		)
-		if p.is(Literal) || p.is(Number) {
+		if p.is(Literal) || p.is(String) || p.is(Number) {
 			next = Value(p.curr.Literal)
 			p.next()
 		} else {
@@ -305,7 +425,7 @@ func (p *Parser) parseObject() (Query, error) {
 		switch p.curr.Type {
 		case Dot:
 			ident = p.peek.Literal
-		case Literal:
+		case Literal, String:
 			ident = p.curr.Literal
 			p.next()
 			if err := p.expect(Colon, "object: expect ':' after literal"); err != nil {
@@ -315,7 +435,7 @@ func (p *Parser) parseObject() (Query, error) {
 		default:
 			return nil, p.parseError("object: expected '.' or literal")
 		}
-		if p.is(Literal) || p.is(Number) {
+		if p.is(Literal) || p.is(String) || p.is(Number) {
 			next = Value(p.curr.Literal)
 			p.next()
 		} else {
@@ -390,12 +510,20 @@ func (p *Parser) next() {
 }
 
 func (p *Parser) parseError(msg string, args ...interface{}) error {
-	return fmt.Errorf(msg, args...)
+	return p.parseErrorAt(p.curr, msg, args...)
+}
+
+func (p *Parser) parseErrorAt(tok Token, msg string, args ...interface{}) error {
+	return ParseError{
+		Position: tok.Position,
+		Message:  fmt.Sprintf(msg, args...),
+	}
 }
 
 const (
 	Eof rune = -(1 + iota)
 	Literal
+	String
 	Number
 	Link
 	Dot
@@ -409,12 +537,14 @@ const (
 	Rcurly
 	Colon
 	Pipe
+	Func
 	Invalid
 )
 
 type Token struct {
 	Literal string
 	Type    rune
+	Position
 }
 
 func (t Token) String() string {
@@ -450,8 +580,12 @@ func (t Token) String() string {
 		return "<invalid>"
 	case Link:
 		return fmt.Sprintf("link(%s)", t.Literal)
+	case Func:
+		return fmt.Sprintf("func(%s)", t.Literal)
 	case Literal:
 		return fmt.Sprintf("literal(%s)", t.Literal)
+	case String:
+		return fmt.Sprintf("string(%s)", t.Literal)
 	case Number:
 		return fmt.Sprintf("number(%s)", t.Literal)
 	default:
@@ -464,17 +598,22 @@ type Scanner struct {
 	curr  int
 	next  int
 	char  rune
+
+	pos  Position
+	prev Position
 }
 
 func Scan(str string) *Scanner {
 	return &Scanner{
 		input: []byte(str),
+		pos:   Position{Line: 1},
 	}
 }
 
 func (s *Scanner) Scan() Token {
 	var tok Token
 	s.read()
+	tok.Position = s.pos
 	if s.done() {
 		tok.Type = Eof
 		return tok
@@ -488,6 +627,8 @@ func (s *Scanner) Scan() Token {
 		s.scanNumber(&tok)
 	case isDelim(s.char):
 		s.scanDelim(&tok)
+	case isFunc(s.char):
+		s.scanFunc(&tok)
 	case isBlank(s.char):
 		s.skipBlank()
 		return s.Scan()
@@ -512,9 +653,12 @@ func (s *Scanner) scanQuote(tok *Token) {
 	s.read()
 	pos := s.curr
 	for !s.done() && s.char != quote {
+		if s.char == '\\' {
+			s.read()
+		}
 		s.read()
 	}
-	tok.Type = Literal
+	tok.Type = String
 	if s.char != quote {
 		tok.Type = Invalid
 	}
@@ -532,6 +676,15 @@ func (s *Scanner) scanNumber(tok *Token) {
 	tok.Literal = string(s.input[pos:s.curr])
 }
 
+func (s *Scanner) scanFunc(tok *Token) {
+	s.read()
+	s.scanIdent(tok)
+	tok.Type = Func
+	if tok.Literal == "" {
+		tok.Type = Invalid
+	}
+}
+
 func (s *Scanner) scanDelim(tok *Token) {
 	switch s.char {
 	case '$':
@@ -578,6 +731,12 @@ func (s *Scanner) read() {
 		return
 	}
 	c, z := utf8.DecodeRune(s.input[s.next:])
+	s.prev = s.pos
+	if s.next > 0 && s.input[s.next-1] == '\n' {
+		s.pos.Line++
+		s.pos.Col = 0
+	}
+	s.pos.Col++
 	s.curr = s.next
 	s.next = s.curr + z
 	s.char = c
@@ -588,6 +747,9 @@ func (s *Scanner) unread() {
 	s.char = c
 	s.next = s.curr
 	s.curr -= z
+	if z > 0 {
+		s.pos = s.prev
+	}
 }
 
 func (s *Scanner) peek() rune {
@@ -620,7 +782,7 @@ func isDigit(r rune) bool {
 }
 
 func isBlank(r rune) bool {
-	return r == ' ' || r == '\t'
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
 }
 
 func isQuote(r rune) bool {
@@ -635,6 +797,10 @@ func isPunct(r rune) bool {
 	return r == '.' || r == ',' || r == ':' || r == '|' || r == '$'
 }
 
+func isFunc(r rune) bool {
+	return r == '@'
+}
+
 func isDelim(r rune) bool {
 	return isGroup(r) || isPunct(r)
 }
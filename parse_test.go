@@ -1,7 +1,10 @@
 package query
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -154,6 +157,22 @@ func TestParse(t *testing.T) {
 			Input: `.foobar | $`,
 			Want:  PipeLine(Ident("foobar"), Pointer(Ident("foobar"))),
 		},
+		{
+			Input: `.["first-name"]`,
+			Want:  Index([]string{"first-name"}),
+		},
+		{
+			Input: `.user["first name", "last.name"]`,
+			Want:  IdentNext("user", Index([]string{"first name", "last.name"})),
+		},
+		{
+			Input: `.a | .b | $0`,
+			Want:  PipeLine(Ident("a"), Ident("b"), Pointer(Ident("a"))),
+		},
+		{
+			Input: `.a | .b | $1`,
+			Want:  PipeLine(Ident("a"), Ident("b"), Pointer(Ident("b"))),
+		},
 	}
 	for _, d := range data {
 		got, err := Parse(d.Input)
@@ -167,6 +186,163 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestOptimize(t *testing.T) {
+	const doc = `{"user": {"name": "foo", "tags": ["a", "b"]}, "items": [{"id": 1}, {"id": 2}]}`
+	data := []struct {
+		Input string
+		Want  Query
+	}{
+		{
+			Input: `. | .user | .name`,
+			Want:  IdentNext("user", Ident("name")),
+		},
+		{
+			Input: `.user | . | .tags[1]`,
+			Want:  IdentNext("user", IdentNext("tags", Index([]string{"1"}))),
+		},
+		{
+			Input: `.items | .[] | .id`,
+			Want:  IdentNext("items", IndexNext(nil, Ident("id"))),
+		},
+		{
+			Input: `. | .`,
+			Want:  All(),
+		},
+		{
+			Input: `{name: . | .user | .name}, [. | .items]`,
+			Want: Any(
+				Object([]string{"name"}, []Query{IdentNext("user", Ident("name"))}),
+				Array(Ident("items")),
+			),
+		},
+		{
+			Input: `.user | {.name} | .name`,
+			Want:  PipeLine(Ident("user"), Object([]string{"name"}, []Query{Ident("name")}), Ident("name")),
+		},
+		{
+			Input: `.items | .[] | $1`,
+			Want:  PipeLine(Ident("items"), PipeLine(Index(nil), Pointer(Index(nil)))),
+		},
+	}
+	for _, d := range data {
+		q, err := Parse(d.Input)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Input, err)
+			continue
+		}
+		opt := Optimize(q)
+		if err := cmpQuery(d.Want, opt); err != nil {
+			t.Errorf("%s: optimized query mismatched: %s", d.Input, err)
+			continue
+		}
+		want, err := run(doc, q)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Input, err)
+			continue
+		}
+		got, err := run(doc, opt)
+		if err != nil {
+			t.Errorf("%s: unexpected error with optimized query: %s", d.Input, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: results mismatched! want %s, got %s", d.Input, want, got)
+		}
+	}
+	for _, str := range []string{`.a | .b | $1`, `.a | . | .b | $0`} {
+		q, err := Parse(str)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", str, err)
+		}
+		opt := Optimize(q)
+		if got := Unparse(opt); got != Unparse(q) {
+			t.Errorf("%s: pipeline with link optimized to %s", str, got)
+		}
+		const doc = `{"a": {"b": [{"x": 1}, {"x": 2}]}}`
+		want, err := run(doc, q)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", str, err)
+			continue
+		}
+		got, err := run(doc, opt)
+		if err != nil {
+			t.Errorf("%s: unexpected error with optimized query: %s", str, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: results mismatched! want %s, got %s", str, want, got)
+		}
+	}
+
+	q := Any(Ident("user"))
+	if _, ok := Optimize(q).(*ident); !ok {
+		t.Errorf("any with single query not replaced by its query")
+	}
+}
+
+func TestOptimizeShared(t *testing.T) {
+	const doc = `{"user": {"name": "foo", "tags": ["b", "a"]}, "items": [{"id": 2}, {"id": 1}]}`
+	queries := []string{
+		`@base64`,
+		`.user.name | @base64`,
+		`.user.tags | sort`,
+		`.items | sort_by(.id) | .[0]`,
+		`{name: .user.name | @base64, items: .items | sort_by(.id)}`,
+		`[.user.name, "x"]`,
+	}
+	for _, str := range queries {
+		q, err := Parse(str)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", str, err)
+			continue
+		}
+		nodes := make(map[Query]bool)
+		Walk(q, func(q Query) bool {
+			if _, ok := q.(*all); !ok {
+				nodes[q] = true
+			}
+			return true
+		})
+		opt := Optimize(q)
+		Walk(opt, func(q Query) bool {
+			if nodes[q] {
+				t.Errorf("%s: node %T shared with the optimized query", str, q)
+			}
+			return true
+		})
+		if err := execute(strings.NewReader(doc), opt); err != nil {
+			t.Errorf("%s: unexpected error: %s", str, err)
+			continue
+		}
+		want, err := Execute(strings.NewReader(doc), str)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", str, err)
+			continue
+		}
+		if got := opt.String(); got != want {
+			t.Errorf("%s: optimized result mismatched! want %s, got %s", str, want, got)
+		}
+		fresh, _ := Parse(str)
+		if got := q.String(); got != fresh.String() {
+			t.Errorf("%s: original query modified: %s", str, got)
+		}
+		if err := execute(strings.NewReader(doc), q); err != nil {
+			t.Errorf("%s: unexpected error: %s", str, err)
+			continue
+		}
+		if got := q.String(); got != want {
+			t.Errorf("%s: original result mismatched! want %s, got %s", str, want, got)
+		}
+	}
+}
+
+func run(doc string, q Query) (string, error) {
+	if err := execute(strings.NewReader(doc), q); err != nil {
+		return "", err
+	}
+	return q.String(), nil
+}
+
 func cmpQuery(q, other Query) error {
 	switch q.(type) {
 	case *ident:
@@ -189,6 +365,12 @@ func cmpQuery(q, other Query) error {
 		return cmpRecurse(q, other)
 	case *ptr:
 		return cmpPtr(q, other)
+	case *regex:
+		return cmpRegex(q, other)
+	case *reduce:
+		return cmpReduce(q, other)
+	case *transform, *add, *edge:
+		return cmpFilter(q, other)
 	default:
 		return fmt.Errorf("unsupported query type %T", q)
 	}
@@ -206,6 +388,55 @@ func cmpRecurse(q, other Query) error {
 	return cmpQuery(i.Query, j.Query)
 }
 
+func cmpRegex(q, other Query) error {
+	i, ok := q.(*regex)
+	if !ok {
+		return fmt.Errorf("regex: unexpected query type %T", q)
+	}
+	j, ok := other.(*regex)
+	if !ok {
+		return fmt.Errorf("regex: unexpected query type %T", other)
+	}
+	if i.name != j.name {
+		return fmt.Errorf("regex: name mismatched! want %s, got %s", i.name, j.name)
+	}
+	if want, got := strings.Join(i.args, ", "), strings.Join(j.args, ", "); want != got {
+		return fmt.Errorf("regex: arguments mismatched! want %s, got %s", want, got)
+	}
+	return nil
+}
+
+func cmpFilter(q, other Query) error {
+	if fmt.Sprintf("%T", q) != fmt.Sprintf("%T", other) {
+		return fmt.Errorf("filter: unexpected query type %T", other)
+	}
+	if want, got := Unparse(q), Unparse(other); want != got {
+		return fmt.Errorf("filter: mismatched! want %s, got %s", want, got)
+	}
+	return nil
+}
+
+func cmpReduce(q, other Query) error {
+	i, ok := q.(*reduce)
+	if !ok {
+		return fmt.Errorf("reduce: unexpected query type %T", q)
+	}
+	j, ok := other.(*reduce)
+	if !ok {
+		return fmt.Errorf("reduce: unexpected query type %T", other)
+	}
+	if i.name != j.name {
+		return fmt.Errorf("reduce: name mismatched! want %s, got %s", i.name, j.name)
+	}
+	if i.by == nil || j.by == nil {
+		if i.by != j.by {
+			return fmt.Errorf("reduce: query mismatched")
+		}
+		return nil
+	}
+	return cmpQuery(i.by, j.by)
+}
+
 func cmpPtr(q, other Query) error {
 	i, ok := q.(*ptr)
 	if !ok {
@@ -367,36 +598,229 @@ func cmpAll(q, other Query) error {
 	return nil
 }
 
+var baseQueries = []string{
+	`.`,
+	`. | .ident`,
+	`.ident | .ident`,
+	`.ident`,
+	`."ident"`,
+	`.'ident'`,
+	`.'ident'[]`,
+	`.'parent'."child"`,
+	`.first.last`,
+	`.first,.last`,
+	`.[]`,
+	`.[0, 1, 2]`,
+	`.array[]`,
+	`.array[].ident`,
+	`.`,
+	`{}`,
+	`{ident: .ident}`,
+	`{.ident}`,
+	`[]`,
+	`[.ident]`,
+	`[.ident] | {data: .ident} | .data`,
+	`.ident[] | {x: .ident, y: (.ident | .ident)}`,
+	`[.ident, (.ident | .ident), .ident]`,
+}
+
 func TestParseBase(t *testing.T) {
-	data := []string{
-		`.`,
-		`. | .ident`,
-		`.ident | .ident`,
-		`.ident`,
-		`."ident"`,
-		`.'ident'`,
-		`.'ident'[]`,
-		`.'parent'."child"`,
-		`.first.last`,
-		`.first,.last`,
-		`.[]`,
-		`.[0, 1, 2]`,
-		`.array[]`,
-		`.array[].ident`,
+	for _, d := range baseQueries {
+		_, err := Parse(d)
+		if err != nil {
+			t.Errorf("%s: parse error: %s", d, err)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	q, err := Parse(`.items[] | {name: .user.name, id: .id}, [.tags[], ..label] | sort_by(.age)`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	idents := func(fn func(Query) bool) []string {
+		var list []string
+		Walk(q, func(q Query) bool {
+			if i, ok := q.(*ident); ok {
+				list = append(list, i.ident)
+			}
+			return fn(q)
+		})
+		return list
+	}
+	got := idents(func(Query) bool { return true })
+	want := []string{"items", "id", "user", "name", "tags", "label", "age"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("idents mismatched! want %v, got %v", want, got)
+	}
+	got = idents(func(q Query) bool {
+		_, ok := q.(*object)
+		return !ok
+	})
+	want = []string{"items", "tags", "label", "age"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("idents mismatched! want %v, got %v", want, got)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	data := []struct {
+		Query string
+		Build *Builder
+	}{
+		{
+			Query: `.`,
+			Build: Q(),
+		},
+		{
+			Query: `.user.name`,
+			Build: Q().Field("user").Field("name"),
+		},
+		{
+			Query: `.items[0, 1].tags[]`,
+			Build: Q().Field("items").Index(0, 1).Field("tags").Iterate(),
+		},
+		{
+			Query: `.["a", "b"]`,
+			Build: Q().Keys("a", "b"),
+		},
+		{
+			Query: `..id`,
+			Build: Q().Recurse().Field("id"),
+		},
+		{
+			Query: `.user[0] | .name`,
+			Build: Q().Field("user").Index(0).Pipe(Q().Field("name")),
+		},
+		{
+			Query: `..user.tags | .[0]`,
+			Build: Q().Recurse().Field("user").Field("tags").Pipe(Q().Index(0)),
+		},
+		{
+			Query: `. | .name`,
+			Build: Q().Pipe(Q().Field("name")),
+		},
+		{
+			Query: `.name | @base64`,
+			Build: Q().Field("name").Then(Transform("base64", nil)),
+		},
+		{
+			Query: `.tags | sort | .[0]`,
+			Build: Q().Field("tags").Then(Sort()).Pipe(Q().Index(0)),
+		},
+		{
+			Query: `{id: .id, user: {name: .user.name, tags: [.tags[], "x"]}}`,
+			Build: Obj().
+				Set("id", Q().Field("id")).
+				Set("user", Obj().
+					Set("name", Q().Field("user").Field("name")).
+					Set("tags", Arr(Q().Field("tags").Iterate(), From(Value("x"))))),
+		},
+		{
+			Query: `.items[] | [.id, {name: .name}]`,
+			Build: Q().Field("items").Iterate().Pipe(Arr(Q().Field("id"), Obj().Set("name", Q().Field("name")))),
+		},
+	}
+	for _, d := range data {
+		want, err := Parse(d.Query)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		got, err := d.Build.Build()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Query, err)
+			continue
+		}
+		if err := cmpQuery(got, want); err != nil {
+			t.Errorf("%s: query mismatched! %s", d.Query, err)
+		}
+	}
+}
+
+func TestBuilder_Error(t *testing.T) {
+	data := []*Builder{
+		Q().Field("a").Recurse(),
+		Q().Recurse(),
+		Q().Set("a", Q()),
+		Obj().Field("a"),
+		From(Sort()).Index(0),
+		Q().Field("a").Pipe(Q().Field("b")).Field("c"),
+		Arr(Q(), Q().Recurse()),
+		Obj().Set("a", Q().Recurse()),
+		Q().Pipe(Obj().Index(0)),
+	}
+	for _, b := range data {
+		q, err := b.Build()
+		if err == nil {
+			t.Errorf("expected error building query, got %s", Unparse(q))
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	queries := []string{
 		`.`,
-		`{}`,
-		`{ident: .ident}`,
-		`{.ident}`,
-		`[]`,
-		`[.ident]`,
-		`[.ident] | {data: .ident} | .data`,
-		`.ident[] | {x: .ident, y: (.ident | .ident)}`,
-		`[.ident, (.ident | .ident), .ident]`,
+		`.user.name`,
+		`.items[0, 1, 2].tags[]`,
+		`..id`,
+		`{id: .id, name: .user.name, tags: [.tags[]]}`,
+		`.items[] | {id: .id, first: .tags[0]} | .first`,
+		`.a, .b, .c | @base64`,
+	}
+	for _, q := range queries {
+		b.Run(q, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Parse(q); err != nil {
+					b.Fatalf("%s: parse error: %s", q, err)
+				}
+			}
+		})
 	}
+}
+
+func TestUnparse(t *testing.T) {
+	data := append([]string{
+		`..ident | $`,
+		`.a | .b | $1`,
+		`.["first name", 0].ident`,
+		`.ident[0][1]`,
+		`{"key with space": .ident, other: 42, str: "foobar"}`,
+		`(.a | .b) | .c`,
+		`test("^a\\s+\"", "i")`,
+		`.name | gsub("(?P<first>\\w+) (\\w+)", "$2 ${first}")`,
+		`unique`,
+		`.items | group_by(.user.id) | .[0]`,
+		`unique_by(.["first name"])`,
+		`sort`,
+		`.users | sort_by(.age) | .[0].name`,
+		`@base64`,
+		`.token | @base64d | .user`,
+		`.list | add`,
+		`.active | not`,
+		`.user | to_entries | from_entries`,
+		`.payload | fromjson | .user | tojson`,
+		`[.codes[] | ascii]`,
+		`{"123": .x, "π": .y, "1st key": .z}`,
+		`.temperature | abs, .price | floor, .price | ceil`,
+		`.items | first | .name, .items | last`,
+		`{user: .user | to_entries, ok: (.flag | not)}`,
+	}, baseQueries...)
 	for _, d := range data {
-		_, err := Parse(d)
+		q, err := Parse(d)
 		if err != nil {
 			t.Errorf("%s: parse error: %s", d, err)
+			continue
+		}
+		str := Unparse(q)
+		other, err := Parse(str)
+		if err != nil {
+			t.Errorf("%s: parse error on %s: %s", d, str, err)
+			continue
+		}
+		if err := cmpQuery(q, other); err != nil {
+			t.Errorf("%s: queries mismatched (%s)! %s", d, str, err)
 		}
 	}
 }
@@ -416,7 +840,22 @@ func TestParse_Error(t *testing.T) {
 		`.array[1 2`,
 		`.[`,
 		`.]`,
-		`.array["foobar"]`,
+		`.array[foobar]`,
+		`.array["foobar", ]`,
+		`.a | .b | $2`,
+		`$0`,
+		`test`,
+		`test(`,
+		`test("a"`,
+		`test("a",)`,
+		`test(42)`,
+		`test("(")`,
+		`test("a", "z")`,
+		`sub("a")`,
+		`group_by`,
+		`group_by(`,
+		`group_by(.a`,
+		`unique_by()`,
 	}
 	for _, d := range data {
 		_, err := Parse(d)
@@ -425,3 +864,42 @@ func TestParse_Error(t *testing.T) {
 		}
 	}
 }
+
+func TestParse_ErrorPosition(t *testing.T) {
+	data := []struct {
+		Input string
+		Position
+	}{
+		{
+			Input:    `. |`,
+			Position: Position{Line: 1, Col: 4},
+		},
+		{
+			Input:    `.array[1 2`,
+			Position: Position{Line: 1, Col: 10},
+		},
+		{
+			Input:    `  .array[foobar]`,
+			Position: Position{Line: 1, Col: 10},
+		},
+		{
+			Input:    `.a | .b | $2`,
+			Position: Position{Line: 1, Col: 11},
+		},
+		{
+			Input:    ".user\n  | .name\n  | ]",
+			Position: Position{Line: 3, Col: 5},
+		},
+	}
+	for _, d := range data {
+		_, err := Parse(d.Input)
+		var perr ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s: expected ParseError, got %T (%v)", d.Input, err, err)
+			continue
+		}
+		if perr.Position != d.Position {
+			t.Errorf("%s: position mismatched! want %s, got %s", d.Input, d.Position, perr.Position)
+		}
+	}
+}
@@ -3,6 +3,9 @@ package query
 import (
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/midbel/slices"
@@ -23,6 +26,7 @@ type Query interface {
 type pipeline struct {
 	Query
 	queries []Query
+	env     *environ
 }
 
 func PipeLine(q Query, next ...Query) Query {
@@ -34,13 +38,14 @@ func PipeLine(q Query, next ...Query) Query {
 
 func (p *pipeline) update(str string) error {
 	for i := range p.queries {
-		r := strings.NewReader(str)
 		p.queries[i].clear()
-
-		if err := execute(r, p.queries[i]); err != nil {
+		if err := executeString(str, p.queries[i], p.env); err != nil {
 			return err
 		}
 		str = p.queries[i].String()
+		if str == "" {
+			return nil
+		}
 	}
 	err := p.Query.update(str)
 	return err
@@ -48,6 +53,7 @@ func (p *pipeline) update(str string) error {
 
 func (p *pipeline) Clone() Query {
 	var q pipeline
+	q.env = p.env
 	q.Query = p.Query.Clone()
 	for i := range p.queries {
 		q.queries = append(q.queries, p.queries[i].Clone())
@@ -94,6 +100,7 @@ func (a *all) Clone() Query {
 
 type ptr struct {
 	Query
+	index int
 }
 
 func Pointer(q Query) Query {
@@ -102,19 +109,15 @@ func Pointer(q Query) Query {
 	}
 }
 
-func cloneQuery(q Query) Query {
-	if p, ok := q.(*ptr); ok {
-		return p.Query.Clone()
-	}
-	return q
-}
-
 func (p *ptr) Clone() Query {
-	return p
+	return &ptr{
+		Query: p.Query.Clone(),
+		index: p.index,
+	}
 }
 
 func (p *ptr) clear() {
-	// noop
+	p.Query.clear()
 }
 
 type recurse struct {
@@ -176,6 +179,494 @@ func (i *literal) Clone() Query {
 	return &q
 }
 
+// transform replaces the value it is given by the result of apply. It is used
+// by the formats (@name) and by the builtins working on a single value.
+type transform struct {
+	name   string
+	apply  FormatFunc
+	value  string
+	format bool
+}
+
+func Transform(name string, fn FormatFunc) Query {
+	return &transform{
+		name:   name,
+		apply:  fn,
+		format: true,
+	}
+}
+
+func builtin(name string, fn FormatFunc) Query {
+	return &transform{
+		name:  name,
+		apply: fn,
+	}
+}
+
+func (t *transform) Next(string) (Query, error) {
+	return nil, errSkip
+}
+
+func (t *transform) String() string {
+	return t.value
+}
+
+func (t *transform) Get() []string {
+	return []string{t.value}
+}
+
+func (t *transform) update(str string) error {
+	res, err := t.apply(str)
+	if err != nil {
+		return fmt.Errorf("%s: %w", t.label(), err)
+	}
+	t.value = res
+	return nil
+}
+
+func (t *transform) label() string {
+	if t.format {
+		return "@" + t.name
+	}
+	return t.name
+}
+
+func (t *transform) clear() {
+	t.value = ""
+}
+
+func (t *transform) Clone() Query {
+	q := *t
+	q.value = ""
+	return &q
+}
+
+type add struct {
+	kind rune
+	sum  float64
+	str  strings.Builder
+}
+
+func Add() Query {
+	var a add
+	return &a
+}
+
+func (a *add) Next(string) (Query, error) {
+	return nil, nil
+}
+
+func (a *add) String() string {
+	switch a.kind {
+	case Number:
+		return strconv.FormatFloat(a.sum, 'f', -1, 64)
+	case Literal:
+		return quoteString(a.str.String())
+	default:
+		return "null"
+	}
+}
+
+func (a *add) Get() []string {
+	return []string{a.String()}
+}
+
+func (a *add) update(str string) error {
+	if str == "null" {
+		return nil
+	}
+	kind := Number
+	if isString(str) {
+		kind = Literal
+	}
+	if a.kind != 0 && a.kind != kind {
+		return fmt.Errorf("add: %s can not be added to a %s", str, kindName(a.kind))
+	}
+	a.kind = kind
+	if kind == Literal {
+		s, err := unquoteString(str)
+		if err != nil {
+			return err
+		}
+		a.str.WriteString(s)
+		return nil
+	}
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return fmt.Errorf("add: %s can not be added (number or string expected)", str)
+	}
+	a.sum += n
+	return nil
+}
+
+func (a *add) clear() {
+	a.kind = 0
+	a.sum = 0
+	a.str.Reset()
+}
+
+func (a *add) Clone() Query {
+	return Add()
+}
+
+func Not() Query {
+	return builtin("not", runNot)
+}
+
+func ToEntries() Query {
+	return builtin("to_entries", runToEntries)
+}
+
+func FromEntries() Query {
+	return builtin("from_entries", runFromEntries)
+}
+
+// edge selects the first (first) or the last (last) element of an array. Once
+// first has its element, the rest of the array is read without being filtered.
+type edge struct {
+	last  bool
+	found bool
+	value string
+}
+
+func First() Query {
+	var e edge
+	return &e
+}
+
+func Last() Query {
+	e := edge{
+		last: true,
+	}
+	return &e
+}
+
+func (e *edge) Next(string) (Query, error) {
+	if e.done() {
+		return nil, errSkip
+	}
+	return nil, nil
+}
+
+func (e *edge) String() string {
+	return e.value
+}
+
+func (e *edge) Get() []string {
+	if !e.found {
+		return nil
+	}
+	return []string{e.value}
+}
+
+func (e *edge) update(str string) error {
+	if e.done() {
+		return nil
+	}
+	e.value = str
+	e.found = true
+	return nil
+}
+
+func (e *edge) done() bool {
+	return e.found && !e.last
+}
+
+func (e *edge) name() string {
+	if e.last {
+		return "last"
+	}
+	return "first"
+}
+
+func (e *edge) clear() {
+	e.value = ""
+	e.found = false
+}
+
+func (e *edge) Clone() Query {
+	q := *e
+	q.clear()
+	return &q
+}
+
+func ToJSON() Query {
+	return builtin("tojson", runToJSON)
+}
+
+func FromJSON() Query {
+	return builtin("fromjson", runFromJSON)
+}
+
+func Ascii() Query {
+	return builtin("ascii", runAscii)
+}
+
+func Abs() Query {
+	return builtin("abs", runAbs)
+}
+
+func Floor() Query {
+	return builtin("floor", runFloor)
+}
+
+func Ceil() Query {
+	return builtin("ceil", runCeil)
+}
+
+// reduce sorts (sort, sort_by), groups (group_by) or dedupes (unique,
+// unique_by) the elements of an array by the values selected by its query in
+// each of them, or by the element itself for sort and unique. Elements are
+// ordered by key like jq does and the sort is stable. The array has to be read
+// in full before anything is given, so reduce does not stream.
+type reduce struct {
+	name  string
+	by    Query
+	value string
+	env   *environ
+}
+
+func Sort() Query {
+	return &reduce{
+		name: "sort",
+	}
+}
+
+func SortBy(q Query) Query {
+	return &reduce{
+		name: "sort_by",
+		by:   q,
+	}
+}
+
+func Unique() Query {
+	return &reduce{
+		name: "unique",
+	}
+}
+
+func UniqueBy(q Query) Query {
+	return &reduce{
+		name: "unique_by",
+		by:   q,
+	}
+}
+
+func GroupBy(q Query) Query {
+	return &reduce{
+		name: "group_by",
+		by:   q,
+	}
+}
+
+func (r *reduce) Next(string) (Query, error) {
+	return nil, errSkip
+}
+
+func (r *reduce) String() string {
+	return r.value
+}
+
+func (r *reduce) Get() []string {
+	return []string{r.value}
+}
+
+func (r *reduce) update(str string) error {
+	list, err := splitArray(str)
+	if err != nil {
+		return fmt.Errorf("%s: %w", r.name, err)
+	}
+	keys := make([]interface{}, len(list))
+	for i := range list {
+		if keys[i], err = r.key(list[i]); err != nil {
+			return fmt.Errorf("%s: %w", r.name, err)
+		}
+	}
+	order := make([]int, len(list))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return compareValues(keys[order[i]], keys[order[j]]) < 0
+	})
+	if r.name == "sort" || r.name == "sort_by" {
+		values := make([]string, len(order))
+		for i, j := range order {
+			values[i] = list[j]
+		}
+		r.value = writeArray(values)
+		return nil
+	}
+	var groups [][]string
+	for i, j := range order {
+		if i == 0 || compareValues(keys[order[i-1]], keys[j]) != 0 {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], list[j])
+	}
+	var values []string
+	for _, g := range groups {
+		if r.name == "group_by" {
+			values = append(values, writeArray(g))
+		} else {
+			values = append(values, g[0])
+		}
+	}
+	r.value = writeArray(values)
+	return nil
+}
+
+func (r *reduce) key(str string) (interface{}, error) {
+	if r.by == nil {
+		return decodeValue(str)
+	}
+	r.by.clear()
+	if err := executeString(str, r.by, r.env); err != nil {
+		return nil, err
+	}
+	var list []interface{}
+	for _, v := range r.by.Get() {
+		k, err := decodeValue(v)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, k)
+	}
+	return list, nil
+}
+
+func (r *reduce) clear() {
+	r.value = ""
+}
+
+func (r *reduce) Clone() Query {
+	q := *r
+	if r.by != nil {
+		q.by = r.by.Clone()
+	}
+	q.value = ""
+	return &q
+}
+
+// regex matches (test) or replaces (sub, gsub) a regular expression in a
+// string. Replacements can refer to capture groups with $1 or ${name}.
+type regex struct {
+	name   string
+	args   []string
+	re     *regexp.Regexp
+	repl   string
+	global bool
+	value  string
+}
+
+func Test(args []string) (Query, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("expected regex and optional flags")
+	}
+	return newRegex("test", args, args[0], "", args[1:])
+}
+
+func Sub(args []string) (Query, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, fmt.Errorf("expected regex, replacement and optional flags")
+	}
+	return newRegex("sub", args, args[0], args[1], args[2:])
+}
+
+func Gsub(args []string) (Query, error) {
+	q, err := Sub(args)
+	if err != nil {
+		return nil, err
+	}
+	r := q.(*regex)
+	r.name = "gsub"
+	r.global = true
+	return r, nil
+}
+
+func newRegex(name string, args []string, pattern, repl string, flags []string) (Query, error) {
+	var flag string
+	if len(flags) > 0 {
+		flag = flags[0]
+	}
+	re, global, err := compileRegex(pattern, flag)
+	if err != nil {
+		return nil, err
+	}
+	r := regex{
+		name:   name,
+		args:   args,
+		re:     re,
+		repl:   repl,
+		global: global,
+	}
+	return &r, nil
+}
+
+func (r *regex) Next(string) (Query, error) {
+	return nil, errSkip
+}
+
+func (r *regex) String() string {
+	return r.value
+}
+
+func (r *regex) Get() []string {
+	return []string{r.value}
+}
+
+func (r *regex) update(str string) error {
+	if !isString(str) {
+		return fmt.Errorf("%s: %s can not be matched (string expected)", r.name, str)
+	}
+	str, err := unquoteString(str)
+	if err != nil {
+		return err
+	}
+	switch {
+	case r.name == "test":
+		r.value = strconv.FormatBool(r.re.MatchString(str))
+	case r.global:
+		r.value = quoteString(r.re.ReplaceAllString(str, r.repl))
+	default:
+		r.value = quoteString(r.replace(str))
+	}
+	return nil
+}
+
+func (r *regex) replace(str string) string {
+	match := r.re.FindStringSubmatchIndex(str)
+	if match == nil {
+		return str
+	}
+	var res []byte
+	res = append(res, str[:match[0]]...)
+	res = r.re.ExpandString(res, r.repl, str, match)
+	res = append(res, str[match[1]:]...)
+	return string(res)
+}
+
+func (r *regex) clear() {
+	r.value = ""
+}
+
+func (r *regex) Clone() Query {
+	q := *r
+	q.value = ""
+	return &q
+}
+
+func kindName(kind rune) string {
+	switch kind {
+	case Number:
+		return "number"
+	case Literal:
+		return "string"
+	default:
+		return "value"
+	}
+}
+
 type ident struct {
 	ident  string
 	values []string
@@ -384,7 +875,6 @@ func Array(list ...Query) Query {
 
 func (a *array) Next(ident string) (Query, error) {
 	for i := range a.list {
-		a.list[i] = cloneQuery(a.list[i])
 		n, err := a.list[i].Next(ident)
 		if err == nil {
 			a.last = a.list[i]
@@ -441,6 +931,9 @@ func (a *array) reset() {
 type object struct {
 	fields map[string]Query
 	keys   []string
+	// nulls writes fields whose query selects nothing as null instead of
+	// dropping them
+	nulls bool
 }
 
 func Object(ks []string, qs []Query) Query {
@@ -457,7 +950,6 @@ func Object(ks []string, qs []Query) Query {
 
 func (o *object) Next(ident string) (Query, error) {
 	for k := range o.fields {
-		o.fields[k] = cloneQuery(o.fields[k])
 		n, err := o.fields[k].Next(ident)
 		if err == nil {
 			o.keys = append(o.keys, k)
@@ -468,25 +960,21 @@ func (o *object) Next(ident string) (Query, error) {
 }
 
 func (o *object) String() string {
-	var (
-		values [][]string
-		keys   []string
-	)
-	for _, k := range o.keys {
-		q := o.fields[k]
-		values = append(values, q.Get())
-		keys = append(keys, k)
-	}
-	for k, q := range o.fields {
-		if _, ok := q.(*literal); ok {
-			keys = append(keys, k)
-			values = append(values, q.Get())
-		}
-	}
+	keys, values := o.values()
 	return writeObject(keys, slices.Combine(values...))
 }
 
 func (o *object) Get() []string {
+	keys, values := o.values()
+	var list []string
+	for _, vs := range slices.Combine(values...) {
+		str := writeObject(keys, [][]string{vs})
+		list = append(list, str)
+	}
+	return list
+}
+
+func (o *object) values() ([]string, [][]string) {
 	var (
 		values [][]string
 		keys   []string
@@ -496,18 +984,29 @@ func (o *object) Get() []string {
 		values = append(values, q.Get())
 		keys = append(keys, k)
 	}
+	var (
+		missing []string
+		seen    = make(map[string]struct{})
+	)
+	for _, k := range o.keys {
+		seen[k] = struct{}{}
+	}
 	for k, q := range o.fields {
 		if _, ok := q.(*literal); ok {
 			keys = append(keys, k)
 			values = append(values, q.Get())
+			continue
+		}
+		if _, ok := seen[k]; o.nulls && !ok {
+			missing = append(missing, k)
 		}
 	}
-	var list []string
-	for _, vs := range slices.Combine(values...) {
-		str := writeObject(keys, [][]string{vs})
-		list = append(list, str)
+	sort.Strings(missing)
+	for _, k := range missing {
+		keys = append(keys, k)
+		values = append(values, []string{"null"})
 	}
-	return list
+	return keys, values
 }
 
 func (o *object) update(str string) error {
@@ -531,6 +1030,7 @@ func (o *object) clear() {
 
 func (o *object) Clone() Query {
 	var q object
+	q.nulls = o.nulls
 	q.fields = make(map[string]Query)
 	for k := range o.fields {
 		q.fields[k] = o.fields[k].Clone()
@@ -588,6 +1088,61 @@ func writeArray(values []string) string {
 }
 
 func keepAll(q Query) bool {
-	_, ok := q.(*all)
-	return ok
+	switch q := q.(type) {
+	case *all:
+		return true
+	case *pipeline:
+		return keepAll(q.Query)
+	default:
+		return false
+	}
+}
+
+// isPath reports whether q only selects values by keys or indexes, optionally
+// followed by a pipeline.
+func isPath(q Query) bool {
+	switch q := q.(type) {
+	case *ident:
+		return q.next == nil || isPath(q.next)
+	case *index:
+		return q.next == nil || isPath(q.next)
+	case *pipeline:
+		return isPath(q.Query)
+	default:
+		return false
+	}
+}
+
+// selected reports whether q can not select more elements of the array being
+// read.
+func selected(q Query) bool {
+	switch q := q.(type) {
+	case *edge:
+		return q.done()
+	case *pipeline:
+		return selected(q.Query)
+	default:
+		return false
+	}
+}
+
+// isSimplePath reports whether q only selects values by keys or indexes.
+func isSimplePath(q Query) bool {
+	switch q := q.(type) {
+	case *ident:
+		return q.next == nil || isSimplePath(q.next)
+	case *index:
+		return q.next == nil || isSimplePath(q.next)
+	default:
+		return false
+	}
+}
+
+func isTransform(q Query) bool {
+	switch q.(type) {
+	case *transform, *regex, *reduce:
+		return true
+	default:
+		return false
+	}
 }
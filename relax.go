@@ -0,0 +1,186 @@
+package query
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// relaxed turns a JSONC document into JSON before it is read. Comments are
+// replaced by blanks and the commas before the end of an array or an object by
+// a space so that the positions given in errors stay the same.
+type relaxed struct {
+	inner *bufio.Reader
+	buf   []byte
+	str   bool
+	esc   bool
+	// last is the last character given outside of strings, comments and
+	// blanks. A comma following '[', '{' or another comma is never dropped.
+	last byte
+	// file, pos and prev are only used to report unterminated comments
+	file string
+	pos  Position
+	prev Position
+}
+
+func relax(r io.Reader) io.Reader {
+	rs := relaxed{
+		inner: bufio.NewReader(r),
+		file:  "<input>",
+	}
+	rs.pos.Line = 1
+	if f, ok := r.(interface{ Name() string }); ok {
+		rs.file = f.Name()
+		return namedReader{
+			Reader: &rs,
+			name:   f.Name(),
+		}
+	}
+	return &rs
+}
+
+func (r *relaxed) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *relaxed) fill() error {
+	c, err := r.readByte()
+	if err != nil {
+		return err
+	}
+	if r.str {
+		r.buf = append(r.buf, c)
+		switch {
+		case r.esc:
+			r.esc = false
+		case c == '\\':
+			r.esc = true
+		case c == '"':
+			r.str = false
+		}
+		return nil
+	}
+	switch {
+	case c == '/' && r.comment():
+		return r.skip()
+	case c == ',':
+		return r.comma()
+	default:
+		r.write(c)
+	}
+	return nil
+}
+
+func (r *relaxed) readByte() (byte, error) {
+	c, err := r.inner.ReadByte()
+	if err != nil {
+		return c, err
+	}
+	r.prev = r.pos
+	if c == '\n' {
+		r.pos.Line++
+		r.pos.Col = 0
+	}
+	if c&0xC0 != 0x80 {
+		r.pos.Col++
+	}
+	return c, nil
+}
+
+func (r *relaxed) unreadByte() {
+	if r.inner.UnreadByte() == nil {
+		r.pos = r.prev
+	}
+}
+
+func (r *relaxed) write(c byte) {
+	r.buf = append(r.buf, c)
+	if jsonQuote(rune(c)) {
+		r.str = true
+	}
+	if !jsonBlank(rune(c)) {
+		r.last = c
+	}
+}
+
+// comma keeps the blanks and comments after a comma aside until the next
+// character tells if the comma is a trailing one.
+func (r *relaxed) comma() error {
+	var (
+		at    = len(r.buf)
+		value = r.last != 0 && r.last != '[' && r.last != '{' && r.last != ','
+	)
+	r.write(',')
+	for {
+		c, err := r.readByte()
+		if err != nil {
+			return nil
+		}
+		switch {
+		case jsonBlank(rune(c)):
+			r.write(c)
+		case c == '/' && r.comment():
+			if err := r.skip(); err != nil {
+				return err
+			}
+		case (c == ']' || c == '}') && value:
+			r.buf[at] = ' '
+			r.write(c)
+			return nil
+		default:
+			r.unreadByte()
+			return nil
+		}
+	}
+}
+
+func (r *relaxed) comment() bool {
+	buf, _ := r.inner.Peek(1)
+	return len(buf) == 1 && (buf[0] == '/' || buf[0] == '*')
+}
+
+// skip replaces a comment by blanks. The newlines are kept and each rune gives
+// one space. A line comment can end the document but a block comment has to be
+// closed.
+func (r *relaxed) skip() error {
+	at := r.pos
+	kind, _ := r.readByte()
+	r.buf = append(r.buf, ' ', ' ')
+	var star bool
+	for {
+		c, err := r.readByte()
+		if errors.Is(err, io.EOF) && kind == '/' {
+			return nil
+		}
+		if errors.Is(err, io.EOF) {
+			return MalformedError{
+				Position: at,
+				File:     r.file,
+				Message:  "unterminated comment",
+			}
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case c == '\n':
+			r.buf = append(r.buf, c)
+		case c&0xC0 != 0x80:
+			r.buf = append(r.buf, ' ')
+		}
+		if kind == '/' && c == '\n' {
+			return nil
+		}
+		if kind == '*' && star && c == '/' {
+			return nil
+		}
+		star = c == '*'
+	}
+}
@@ -0,0 +1,43 @@
+package query
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// SniffJSON reports whether the first non blank character of r starts a JSON
+// object, array or string. The returned reader gives back the whole input.
+func SniffJSON(r io.Reader) (io.Reader, bool, error) {
+	var (
+		rs           = bufio.NewReader(r)
+		rd io.Reader = rs
+		ok bool
+	)
+	if f, named := r.(interface{ Name() string }); named {
+		rd = namedReader{
+			Reader: rs,
+			name:   f.Name(),
+		}
+	}
+	start := 1
+	if buf, _ := rs.Peek(3); string(buf) == string(bom) {
+		start += len(buf)
+	}
+	for i := start; ; i++ {
+		buf, err := rs.Peek(i)
+		if len(buf) < i {
+			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+				return nil, false, err
+			}
+			break
+		}
+		c := rune(buf[i-1])
+		if jsonBlank(c) {
+			continue
+		}
+		ok = jsonObject(c) || jsonArray(c) || jsonQuote(c)
+		break
+	}
+	return rd, ok, nil
+}
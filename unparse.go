@@ -0,0 +1,173 @@
+package query
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Unparse gives back the textual form of a query. Parsing the result of
+// Unparse gives a query equivalent to q.
+func Unparse(q Query) string {
+	var str strings.Builder
+	unparse(&str, q)
+	return str.String()
+}
+
+func unparse(w *strings.Builder, q Query) {
+	switch q := q.(type) {
+	case nil:
+	case *all:
+		w.WriteString(".")
+	case *ident:
+		w.WriteString(".")
+		w.WriteString(unparseKey(q.ident))
+		unparseNext(w, q.next)
+	case *index:
+		w.WriteString(".")
+		unparseIndex(w, q)
+	case *recurse:
+		w.WriteString(".")
+		unparse(w, q.Query)
+	case *ptr:
+		w.WriteString("$")
+		if q.index > 0 {
+			w.WriteString(strconv.Itoa(q.index))
+		}
+	case *literal:
+		w.WriteString(unparseValue(q.value))
+	case *transform:
+		w.WriteString(q.label())
+	case *add:
+		w.WriteString("add")
+	case *edge:
+		w.WriteString(q.name())
+	case *reduce:
+		w.WriteString(q.name)
+		if q.by != nil {
+			w.WriteString("(")
+			unparse(w, q.by)
+			w.WriteString(")")
+		}
+	case *regex:
+		w.WriteString(q.name)
+		w.WriteString("(")
+		for i := range q.args {
+			if i > 0 {
+				w.WriteString(", ")
+			}
+			w.WriteString(quoteString(q.args[i]))
+		}
+		w.WriteString(")")
+	case *pipeline:
+		list := q.queries
+		if _, ok := q.Query.(*all); !ok || len(list) == 0 || !isTransform(list[0]) {
+			list = append([]Query{q.Query}, list...)
+		}
+		unparseStages(w, list)
+	case *any:
+		for i := range q.list {
+			if i > 0 {
+				w.WriteString(", ")
+			}
+			unparse(w, q.list[i])
+		}
+	case *array:
+		w.WriteString("[")
+		for i := range q.list {
+			if i > 0 {
+				w.WriteString(", ")
+			}
+			unparse(w, q.list[i])
+		}
+		w.WriteString("]")
+	case *object:
+		var keys []string
+		for k := range q.fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w.WriteString("{")
+		for i, k := range keys {
+			if i > 0 {
+				w.WriteString(", ")
+			}
+			w.WriteString(unparseKey(k))
+			w.WriteString(": ")
+			unparse(w, q.fields[k])
+		}
+		w.WriteString("}")
+	}
+}
+
+func unparseStages(w *strings.Builder, list []Query) {
+	for i := range list {
+		if i > 0 {
+			w.WriteString(" | ")
+		}
+		if _, ok := list[i].(*pipeline); ok {
+			w.WriteString("(")
+			unparse(w, list[i])
+			w.WriteString(")")
+			continue
+		}
+		unparse(w, list[i])
+	}
+}
+
+func unparseNext(w *strings.Builder, q Query) {
+	switch q := q.(type) {
+	case *index:
+		unparseIndex(w, q)
+	case *pipeline:
+		i, ok := q.Query.(*index)
+		if !ok {
+			unparse(w, q)
+			break
+		}
+		unparseIndex(w, i)
+		w.WriteString(" | ")
+		unparseStages(w, q.queries)
+	default:
+		unparse(w, q)
+	}
+}
+
+func unparseIndex(w *strings.Builder, q *index) {
+	w.WriteString("[")
+	for i := range q.list {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		if _, err := strconv.Atoi(q.list[i]); err == nil {
+			w.WriteString(q.list[i])
+		} else {
+			w.WriteString(`"` + q.list[i] + `"`)
+		}
+	}
+	w.WriteString("]")
+	unparseNext(w, q.next)
+}
+
+func unparseKey(key string) string {
+	for i, c := range key {
+		if (i == 0 && !isLetter(c)) || !isAlpha(c) {
+			return `"` + key + `"`
+		}
+	}
+	if key == "" {
+		return `""`
+	}
+	return key
+}
+
+func unparseValue(value string) string {
+	switch value {
+	case "true", "false", "null":
+		return value
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return value
+	}
+	return `"` + value + `"`
+}
@@ -0,0 +1,48 @@
+package query
+
+import (
+	"sort"
+)
+
+// Walk visits q and the queries it is made of, depth first. The children of a
+// query are only visited when fn returns true for it. The fields of an object
+// are visited in the order of their names.
+func Walk(q Query, fn func(Query) bool) {
+	if q == nil || !fn(q) {
+		return
+	}
+	switch q := q.(type) {
+	case *pipeline:
+		Walk(q.Query, fn)
+		for i := range q.queries {
+			Walk(q.queries[i], fn)
+		}
+	case *any:
+		for i := range q.list {
+			Walk(q.list[i], fn)
+		}
+	case *array:
+		for i := range q.list {
+			Walk(q.list[i], fn)
+		}
+	case *object:
+		keys := make([]string, 0, len(q.fields))
+		for k := range q.fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			Walk(q.fields[k], fn)
+		}
+	case *ident:
+		Walk(q.next, fn)
+	case *index:
+		Walk(q.next, fn)
+	case *recurse:
+		Walk(q.Query, fn)
+	case *ptr:
+		Walk(q.Query, fn)
+	case *reduce:
+		Walk(q.by, fn)
+	}
+}